@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/exporter"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/output"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// queryCommand runs an arbitrary query against PuppetDB and prints the result
+type queryCommand struct {
+	config *Config
+
+	Output   string `short:"o" long:"output" description:"Output format." choice:"table" choice:"json" choice:"csv" choice:"prom" default:"table"`
+	Endpoint string `long:"endpoint" description:"Endpoint to query with an AST query, e.g. nodes or facts. PQL queries are sent to the root endpoint when empty."`
+	Name     string `long:"name" description:"Metric name used by the prom output." default:"puppetdb_query"`
+	Value    string `long:"value" description:"Field holding the sample value in the prom output. Samples are set to 1 when empty."`
+	Args     struct {
+		Query string `positional-arg-name:"query" required:"true"`
+	} `positional-args:"yes"`
+}
+
+// unreportedCommand lists the nodes considered unreported
+type unreportedCommand struct {
+	config *Config
+
+	Output string `short:"o" long:"output" description:"Output format." choice:"table" choice:"json" choice:"csv" choice:"prom" default:"table"`
+}
+
+// checkConfigCommand validates the configuration
+type checkConfigCommand struct {
+	config *Config
+
+	Connect bool `long:"connect" description:"Also check that PuppetDB can be queried."`
+}
+
+// healthcheckCommand checks the readiness of a running exporter
+type healthcheckCommand struct {
+	config *Config
+
+	URL     string        `long:"url" description:"URL of the readiness endpoint. (default: /readyz on --listen-address)"`
+	Timeout time.Duration `long:"timeout" description:"Timeout of the check." default:"5s"`
+}
+
+func addCommands(parser *flags.Parser, c *Config) {
+	parser.SubcommandsOptional = true
+
+	parser.AddCommand("query", "Run a PuppetDB query",
+		"Run a PQL or AST query against PuppetDB and print the resulting rows.",
+		&queryCommand{config: c})
+	parser.AddCommand("unreported", "List unreported nodes",
+		"List the nodes which are considered unreported along with the reason.",
+		&unreportedCommand{config: c})
+	parser.AddCommand("check-config", "Validate the configuration",
+		"Validate the durations, categories, filters and TLS files of the configuration, and optionally the connection to PuppetDB, then exit.",
+		&checkConfigCommand{config: c})
+	parser.AddCommand("healthcheck", "Check the exporter readiness",
+		"Query the readiness endpoint of the running exporter and exit with a non-zero status unless it is ready.",
+		&healthcheckCommand{config: c})
+}
+
+// Execute implements flags.Commander
+func (cmd *healthcheckCommand) Execute(args []string) error {
+	url := cmd.URL
+	if url == "" {
+		host, port, err := net.SplitHostPort(cmd.config.ListenAddress[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse listen address: %s", err)
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		url = "http://" + net.JoinHostPort(host, port) + "/readyz"
+	}
+
+	client := &http.Client{Timeout: cmd.Timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("exporter not ready: %s", resp.Status)
+	}
+	return nil
+}
+
+// Execute implements flags.Commander
+func (cmd *queryCommand) Execute(args []string) error {
+	opts, err := cmd.config.clientOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := puppetdb.NewClient(opts)
+	if err != nil {
+		return err
+	}
+
+	rows, err := client.Query(context.Background(), cmd.Endpoint, cmd.Args.Query)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]struct{}{}
+	for _, row := range rows {
+		for field := range row {
+			fields[field] = struct{}{}
+		}
+	}
+
+	t := &output.Table{
+		Name:  cmd.Name,
+		Help:  fmt.Sprintf("PuppetDB query: %s", cmd.Args.Query),
+		Value: cmd.Value,
+	}
+	for field := range fields {
+		t.Columns = append(t.Columns, field)
+	}
+	sort.Strings(t.Columns)
+
+	for _, row := range rows {
+		cells := make([]interface{}, len(t.Columns))
+		for i, column := range t.Columns {
+			cells[i] = row[column]
+		}
+		t.Rows = append(t.Rows, cells)
+	}
+
+	return output.Write(os.Stdout, cmd.Output, t)
+}
+
+// Execute implements flags.Commander
+func (cmd *checkConfigCommand) Execute(args []string) error {
+	c := cmd.config
+	var errs []string
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	_, err := time.ParseDuration(c.ScrapeInterval)
+	check("scrape-interval", err)
+	_, err = time.ParseDuration(c.UnreportedNode)
+	check("unreported-node", err)
+	_, err = time.ParseDuration(c.ScrapeTimeout)
+	check("scrape.timeout", err)
+	_, err = time.ParseDuration(c.Splay)
+	check("scrape.splay", err)
+	_, err = time.ParseDuration(c.FullRefresh)
+	check("scrape.full-refresh-interval", err)
+	_, err = time.ParseDuration(c.Overlap)
+	check("scrape.incremental-overlap", err)
+	if c.AutoTuneFrac <= 0 || c.AutoTuneFrac > 1 {
+		check("scrape.auto-tune-fraction", fmt.Errorf("must be in (0, 1], got %g", c.AutoTuneFrac))
+	}
+	_, err = compileFilter(c.CertnameIncl)
+	check("filter.certname-include", err)
+	_, err = compileFilter(c.CertnameExcl)
+	check("filter.certname-exclude", err)
+	_, err = c.hostMapper()
+	check("host-label", err)
+	check("shard", c.checkShard())
+	_, err = time.LoadLocation(c.TimeLocation)
+	check("timestamp-location", err)
+	if c.CA && c.PuppetServer == "" {
+		check("collector.ca", errors.New("requires --puppetserver.url"))
+	}
+
+	// Creating the clients loads their TLS files, once the Vault credentials
+	// are fetched
+	var client *puppetdb.PuppetDB
+	var opts *puppetdb.Options
+	_, err = c.credentials()
+	check("credentials", err)
+	if err == nil {
+		opts, err = c.clientOptions()
+		check("query-timeout", err)
+	}
+	if err == nil {
+		client, err = puppetdb.NewClient(opts)
+		check("puppetdb", err)
+
+		_, err = c.puppetServer(opts.Timeouts)
+		check("puppetserver", err)
+		_, err = c.classifier(opts.Timeouts)
+		check("pe.classifier", err)
+		_, err = c.codeManager(opts.Timeouts)
+		check("pe.code-manager", err)
+		_, err = c.resolver(opts.Timeouts)
+		check("discovery", err)
+	}
+	_, err = c.remoteWrite()
+	check("remote-write", err)
+	_, err = c.catalogResources()
+	check("collector.catalog-resource", err)
+	_, err = c.thresholdOverrides()
+	check("facts.unreported-threshold-override", err)
+	_, err = c.reportMetrics()
+	check("categories.metric", err)
+	_, err = c.queries()
+	check("queries.file", err)
+
+	// The metric and label names are checked by the exporter itself, once
+	// the options it is created with are valid
+	if len(errs) == 0 {
+		var expOpts *exporter.Options
+		expOpts, err = c.exporterOptions(opts.Timeouts)
+		check("exporter", err)
+		if err == nil {
+			check("exporter", exporter.CheckOptions(expOpts))
+		}
+	}
+
+	if cmd.Connect && client != nil {
+		_, err = client.Query(context.Background(), "", "nodes[certname] { limit 1 }")
+		check("puppetdb connection", err)
+	}
+
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return fmt.Errorf("configuration has %d error(s)", len(errs))
+	}
+
+	fmt.Println("configuration OK")
+	return nil
+}
+
+// Execute implements flags.Commander
+func (cmd *unreportedCommand) Execute(args []string) error {
+	unreportedDuration, err := time.ParseDuration(cmd.config.UnreportedNode)
+	if err != nil {
+		return fmt.Errorf("failed to parse unreported duration: %s", err)
+	}
+	if err := cmd.config.addTimestampLayouts(); err != nil {
+		return err
+	}
+
+	opts, err := cmd.config.clientOptions()
+	if err != nil {
+		return err
+	}
+
+	// The exporter filters the nodes and applies the unreported thresholds
+	// as it does when scraping, its metrics being registered apart
+	expOpts, err := cmd.config.exporterOptions(opts.Timeouts)
+	if err != nil {
+		return err
+	}
+	expOpts.Registerer = prometheus.NewRegistry()
+	exp, err := exporter.NewPuppetDBExporter(opts, expOpts)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := exp.Unreported(context.Background(), unreportedDuration)
+	if err != nil {
+		return err
+	}
+
+	t := &output.Table{
+		Name:    "puppet_report_unreported",
+		Help:    "Timestamp of latest report of unreported nodes",
+		Value:   "timestamp",
+		Columns: []string{"host", "environment", "reason", "timestamp"},
+	}
+	for _, node := range nodes {
+		var timestamp float64
+		if node.LatestReport != nil {
+			timestamp = float64(node.LatestReport.Unix())
+		}
+		t.Rows = append(t.Rows, []interface{}{node.Host, node.Environment, node.Reason, timestamp})
+	}
+
+	return output.Write(os.Stdout, cmd.Output, t)
+}
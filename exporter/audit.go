@@ -0,0 +1,142 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditReport describes the series published during the latest cycle
+type AuditReport struct {
+	Time     time.Time      `json:"time"`
+	Families []FamilyReport `json:"families"`
+}
+
+// FamilyReport describes the series of a metric family and how they changed
+// since the previous cycle
+type FamilyReport struct {
+	Name    string `json:"name"`
+	Series  int    `json:"series"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	// LabelNames are the label names shared by the series of the family
+	LabelNames []string `json:"label_names"`
+	// Inconsistent lists series whose label names differ from LabelNames
+	Inconsistent []string `json:"inconsistent,omitempty"`
+	// Duplicates lists series published more than once in the same cycle,
+	// of which only the last value is exported
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+// seriesAudit compares the series of every metric family across cycles
+type seriesAudit struct {
+	previous map[string]map[string]struct{}
+
+	mu     sync.Mutex
+	report AuditReport
+}
+
+// check audits the series about to be published, reporting them under their
+// full metric names
+func (a *seriesAudit) check(reports map[string][]metric, fqNames map[string]string) {
+	current := make(map[string]map[string]struct{}, len(reports))
+	report := AuditReport{Time: time.Now()}
+	var names []string
+
+	for family, ms := range reports {
+		series := make(map[string]struct{}, len(ms))
+		fr := FamilyReport{Name: fqNames[family], Series: len(ms)}
+
+		for i, m := range ms {
+			names = names[:0]
+			for name := range m.labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			sig := signature(names, m)
+			if i == 0 {
+				fr.LabelNames = append([]string(nil), names...)
+			} else if !slices.Equal(names, fr.LabelNames) {
+				fr.Inconsistent = append(fr.Inconsistent, sig)
+			}
+
+			if _, ok := series[sig]; ok {
+				fr.Duplicates = append(fr.Duplicates, sig)
+			}
+			series[sig] = struct{}{}
+		}
+
+		prev := a.previous[family]
+		for sig := range series {
+			if _, ok := prev[sig]; !ok {
+				fr.Added++
+			}
+		}
+		for sig := range prev {
+			if _, ok := series[sig]; !ok {
+				fr.Removed++
+			}
+		}
+
+		if len(fr.Inconsistent) > 0 {
+			log.Warnf("%d series of %s have inconsistent label names", len(fr.Inconsistent), fr.Name)
+		}
+		if len(fr.Duplicates) > 0 {
+			log.Warnf("%d series of %s are duplicated", len(fr.Duplicates), fr.Name)
+		}
+		if fr.Added > 0 || fr.Removed > 0 {
+			log.Debugf("series churn of %s: %d added, %d removed", fr.Name, fr.Added, fr.Removed)
+		}
+
+		current[family] = series
+		report.Families = append(report.Families, fr)
+	}
+	sort.Slice(report.Families, func(i, j int) bool { return report.Families[i].Name < report.Families[j].Name })
+
+	a.previous = current
+
+	a.mu.Lock()
+	a.report = report
+	a.mu.Unlock()
+}
+
+// signature identifies a series by its labels in name order
+func signature(names []string, m metric) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(m.labels[name])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// AuditHandler serves the report of the latest series audit as JSON
+func (e *Exporter) AuditHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.audit == nil {
+			http.Error(w, "series audit is disabled", http.StatusNotFound)
+			return
+		}
+
+		e.audit.mu.Lock()
+		report := e.audit.report
+		e.audit.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
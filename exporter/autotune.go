@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// autoTuneCycles is the number of consecutive cycles needed to change the
+// effective scrape interval
+const autoTuneCycles = 3
+
+// intervalTuner stretches the scrape interval when cycles consistently take
+// more than a fraction of it, and shrinks it back towards the configured
+// interval once they get faster again
+type intervalTuner struct {
+	interval  time.Duration
+	effective time.Duration
+	fraction  float64
+	slow      int
+	fast      int
+}
+
+func newIntervalTuner(interval time.Duration, fraction float64) *intervalTuner {
+	return &intervalTuner{
+		interval:  interval,
+		effective: interval,
+		fraction:  fraction,
+	}
+}
+
+// observe records the duration of a cycle and returns the interval to wait
+// before the next one
+func (t *intervalTuner) observe(elapsed time.Duration) time.Duration {
+	budget := time.Duration(float64(t.effective) * t.fraction)
+
+	switch {
+	case elapsed > budget:
+		t.slow++
+		t.fast = 0
+	case elapsed < budget/2 && t.effective > t.interval:
+		t.fast++
+		t.slow = 0
+	default:
+		t.slow, t.fast = 0, 0
+	}
+
+	if t.slow < autoTuneCycles && t.fast < autoTuneCycles {
+		return t.effective
+	}
+	t.slow, t.fast = 0, 0
+
+	// Leave the cycle the configured fraction of the interval
+	effective := time.Duration(math.Ceil(float64(elapsed)/t.fraction/float64(time.Second))) * time.Second
+	if effective < t.interval {
+		effective = t.interval
+	}
+	if effective != t.effective {
+		log.Infof("scrape cycles take %s, adjusting the scrape interval from %s to %s", elapsed.Round(time.Millisecond), t.effective, effective)
+		t.effective = effective
+	}
+	return t.effective
+}
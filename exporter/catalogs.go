@@ -0,0 +1,70 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CatalogResource is a resource type, and optionally title, whose nodes are
+// counted, e.g. Class[Profile::Base] or Service
+type CatalogResource struct {
+	Type  string
+	Title string
+}
+
+var catalogResourceRef = regexp.MustCompile(`^([A-Za-z][\w:]*)(?:\[(.+)\])?$`)
+
+// ParseCatalogResource parses a resource reference such as Class[Profile::Base]
+// or a resource type. Classes are capitalized the way PuppetDB stores them.
+func ParseCatalogResource(ref string) (CatalogResource, error) {
+	m := catalogResourceRef.FindStringSubmatch(ref)
+	if m == nil {
+		return CatalogResource{}, fmt.Errorf("invalid resource reference %q", ref)
+	}
+
+	r := CatalogResource{Type: capitalize(m[1]), Title: m[2]}
+	if r.Type == "Class" {
+		r.Title = capitalize(r.Title)
+	}
+	return r, nil
+}
+
+// capitalize capitalizes every segment of a qualified name, e.g.
+// profile::base into Profile::Base
+func capitalize(name string) string {
+	segments := strings.Split(name, "::")
+	for i, s := range segments {
+		if s != "" {
+			segments[i] = strings.ToUpper(s[:1]) + s[1:]
+		}
+	}
+	return strings.Join(segments, "::")
+}
+
+// countCatalogResources counts the active nodes whose catalog holds each of
+// the CatalogResources
+func (e *Exporter) countCatalogResources(ctx context.Context) error {
+	var errs []error
+	for _, r := range e.options.CatalogResources {
+		certnames, err := e.client.ResourceCertnames(ctx, r.Type, r.Title)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		count := 0
+		for _, certname := range certnames {
+			if e.included(certname) {
+				count++
+			}
+		}
+
+		labels := e.appendMetric("nodes_with_resource", float64(count))
+		labels["type"] = r.Type
+		labels["title"] = r.Title
+	}
+	return errors.Join(errs...)
+}
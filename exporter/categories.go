@@ -0,0 +1,132 @@
+package exporter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportReportMetric reports whether the report metric of an exported
+// category is exported, i.e. whether its name is listed by ReportMetrics when
+// some of the metrics of its category are
+func (e *Exporter) exportReportMetric(category, name string) bool {
+	names, ok := e.options.ReportMetrics[category]
+	if !ok {
+		return true
+	}
+	_, ok = names[name]
+	return ok
+}
+
+// exportCategory reports whether the report metrics of a category are
+// exported. With AutoCategories, a category is exported from the first
+// report holding it, unless it is excluded, its gauge being created by
+// addCategories at the end of the cycle.
+func (e *Exporter) exportCategory(category string) bool {
+	if _, ok := e.options.Categories[category]; ok {
+		return true
+	}
+	if !e.options.AutoCategories || slices.Contains(e.options.ExcludeCategories, category) {
+		return false
+	}
+
+	name := fmt.Sprintf("report_%s", category)
+	if !model.IsValidMetricName(model.LabelValue(prometheus.BuildFQName(e.nodeNamespace, "", name))) {
+		log.Warnf("report metrics category %q is not a valid metric name, excluded", category)
+		e.options.ExcludeCategories = append(e.options.ExcludeCategories, category)
+		return false
+	}
+	if _, ok := e.metrics[name]; ok {
+		log.Warnf("report metrics category %q conflicts with the %s metric, excluded", category, e.fqNames[name])
+		e.options.ExcludeCategories = append(e.options.ExcludeCategories, category)
+		return false
+	}
+
+	e.options.Categories[category] = struct{}{}
+	e.discovered = append(e.discovered, category)
+	return true
+}
+
+// addCategories creates and registers the gauges of the discovered
+// categories. A category whose gauge cannot be registered is excluded, along
+// with its metrics.
+func (e *Exporter) addCategories() {
+	for _, category := range e.discovered {
+		name := fmt.Sprintf("report_%s", category)
+		err := e.newCategoryGauge(category)
+		if err == nil {
+			err = e.registry.Register(e.metrics[name])
+		}
+		if err != nil {
+			log.Errorf("failed to add report metrics category %s, excluded: %s", category, err)
+			delete(e.options.Categories, category)
+			e.options.ExcludeCategories = append(e.options.ExcludeCategories, category)
+			delete(e.metrics, name)
+			delete(e.fqNames, name)
+			delete(e.labelSources, name)
+			delete(e.reports, name)
+			continue
+		}
+
+		log.Infof("report metrics category %s discovered", category)
+		e.autoCategories = append(e.autoCategories, category)
+	}
+	e.discovered = e.discovered[:0]
+}
+
+// categoryLabelNames returns the label names of the report metrics of the
+// categories, the name and host labels and the given labels only when some
+// are given, and an error if one of them is unknown. The host label is always
+// kept, the metrics of the nodes being otherwise exported as the same series.
+func categoryLabelNames(factLabels, labels []string) ([]string, error) {
+	labelNames := append([]string{"name", "environment", "host", "deactivated", "status"}, factLabels...)
+	if len(labels) == 0 {
+		return labelNames, nil
+	}
+
+	for _, label := range labels {
+		if !slices.Contains(labelNames, label) {
+			return nil, fmt.Errorf("unknown report metrics label %s, expected one of %s", label, strings.Join(labelNames, ", "))
+		}
+	}
+	return slices.DeleteFunc(labelNames, func(label string) bool {
+		return label != "name" && label != "host" && !slices.Contains(labels, label)
+	}), nil
+}
+
+// initCategoryGauges creates the gauges of the report metrics categories once
+// the other gauges are, so that the categories clashing with them are
+// reported
+func (e *Exporter) initCategoryGauges() error {
+	for category := range e.options.Categories {
+		name := fmt.Sprintf("report_%s", category)
+		fqName := prometheus.BuildFQName(e.nodeNamespace, "", name)
+		if category == "" || !model.IsValidMetricName(model.LabelValue(fqName)) {
+			return fmt.Errorf("report metrics category %q is not a valid metric name", category)
+		}
+		if _, ok := e.metrics[name]; ok {
+			return fmt.Errorf("report metrics category %q conflicts with the %s metric", category, fqName)
+		}
+		if err := e.newCategoryGauge(category); err != nil {
+			return err
+		}
+	}
+
+	// The gauges of discovered categories share the labels of the other
+	// categories, which are checked beforehand
+	if e.options.AutoCategories {
+		if _, _, err := e.relabel(prometheus.BuildFQName(e.nodeNamespace, "", "report_<category>"), e.categoryLabels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCategoryGauge creates the gauge of the report metrics of a category
+func (e *Exporter) newCategoryGauge(category string) error {
+	return e.addGauge(e.nodeNamespace, fmt.Sprintf("report_%s", category), fmt.Sprintf("Total count of %s per status", category), e.categoryLabels)
+}
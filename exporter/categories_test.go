@@ -0,0 +1,29 @@
+package exporter
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCategoryLabelNames(t *testing.T) {
+	for _, tc := range []struct {
+		labels []string
+		want   []string
+	}{
+		{want: []string{"name", "environment", "host", "deactivated", "status", "role"}},
+		{labels: []string{"environment"}, want: []string{"name", "environment", "host"}},
+		{labels: []string{"role"}, want: []string{"name", "host", "role"}},
+	} {
+		got, err := categoryLabelNames([]string{"role"}, tc.labels)
+		if err != nil {
+			t.Fatalf("failed to get the label names of %v: %s", tc.labels, err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("got the label names %v for %v, want %v", got, tc.labels, tc.want)
+		}
+	}
+
+	if _, err := categoryLabelNames(nil, []string{"unknown"}); err == nil {
+		t.Error("expected an error for an unknown label")
+	}
+}
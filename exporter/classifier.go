@@ -0,0 +1,31 @@
+package exporter
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/classifier"
+)
+
+// fetchNodeGroups stores the comma separated PE node groups each node is
+// pinned to in its facts
+func (e *Exporter) fetchNodeGroups(ctx context.Context, facts nodeFacts) {
+	groups, err := e.options.Classifier.Groups(ctx)
+	if err != nil {
+		log.Errorf("failed to get node groups: %s", err)
+		return
+	}
+
+	// The facts may be those of the previous cycle, pinned to groups since
+	for _, values := range facts {
+		delete(values, nodeGroupsKey)
+	}
+	for certname, names := range classifier.PinnedGroups(groups) {
+		if facts[certname] == nil {
+			facts[certname] = map[string]interface{}{}
+		}
+		facts[certname][nodeGroupsKey] = e.labels.intern(strings.Join(names, ","))
+	}
+}
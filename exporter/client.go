@@ -0,0 +1,33 @@
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// clientCollector exports the time of the latest successful query of the
+// PuppetDB client by query type, e.g. nodes, reports or status, revealing
+// which API calls fail when the data goes stale, along with the responses
+// reused after conditional requests
+type clientCollector struct {
+	client      puppetdb.Client
+	lastSuccess *prometheus.Desc
+	cacheHits   *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector
+func (c *clientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lastSuccess
+	ch <- c.cacheHits
+}
+
+// Collect implements prometheus.Collector
+func (c *clientCollector) Collect(ch chan<- prometheus.Metric) {
+	for queryType, t := range c.client.LastSuccess() {
+		ch <- prometheus.MustNewConstMetric(c.lastSuccess, prometheus.GaugeValue, float64(t.UnixNano())/1e9, queryType)
+	}
+	for queryType, count := range c.client.CacheHits() {
+		ch <- prometheus.MustNewConstMetric(c.cacheHits, prometheus.CounterValue, count, queryType)
+	}
+}
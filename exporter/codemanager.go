@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkCodeManager records the status of the Code Manager deployments and
+// the code deployed in each environment
+func (e *Exporter) checkCodeManager(ctx context.Context) {
+	status, err := e.options.CodeManager.DeployStatus(ctx)
+	if err != nil {
+		log.Errorf("failed to check Code Manager status: %s", err)
+		e.appendMetric("pe_code_manager_up", 0)
+		return
+	}
+	e.appendMetric("pe_code_manager_up", 1)
+
+	for _, deploys := range []struct {
+		status string
+		count  int
+	}{
+		{"new", len(status.DeploysStatus.New)},
+		{"queued", len(status.DeploysStatus.Queued)},
+		{"deploying", len(status.DeploysStatus.Deploying)},
+		{"failed", len(status.DeploysStatus.Failed)},
+	} {
+		labels := e.appendMetric("pe_code_deploys", float64(deploys.count))
+		labels["status"] = deploys.status
+	}
+
+	for _, deploy := range status.FileSyncStorageStatus.Deployed {
+		environment := e.labels.intern(deploy.Environment)
+
+		labels := e.appendMetric("pe_code_deploy_info", 1)
+		labels["environment"] = environment
+		labels["signature"] = deploy.DeploySignature
+
+		date, err := time.Parse(time.RFC3339, deploy.Date)
+		if err != nil {
+			log.Debugf("invalid deploy date of %s: %s", deploy.Environment, err)
+			continue
+		}
+		labels = e.appendMetric("pe_code_deploy_timestamp", float64(date.Unix()))
+		labels["environment"] = environment
+	}
+
+	e.appendMetric("pe_code_file_sync_clients_synced", boolValue(status.FileSyncClientStatus.AllSynced))
+}
+
+func (e *Exporter) initCodeManagerGauges() {
+	e.newGauge(e.namespace, "pe_code_manager_up", "Whether the Code Manager API could be reached", nil)
+	e.newGauge(e.namespace, "pe_code_deploys", "Number of Code Manager deployments by status", []string{"status"})
+	e.newGauge(e.namespace, "pe_code_deploy_info", "Signature of the code deployed in an environment", []string{"environment", "signature"})
+	e.newGauge(e.namespace, "pe_code_deploy_timestamp", "Time of the latest code deployment of an environment", []string{"environment"})
+	e.newGauge(e.namespace, "pe_code_file_sync_clients_synced", "Whether every file sync client is synced with the file sync storage", nil)
+}
@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// commandMBeans matches the global command processing MBeans of PuppetDB
+const commandMBeans = "puppetlabs.puppetdb.mq:name=global.*"
+
+// commandMeters maps the command processing MBeans to the counters exporting
+// their count
+var commandMeters = map[string]string{
+	"puppetlabs.puppetdb.mq:name=global.processed": "commands_processed_total",
+	"puppetlabs.puppetdb.mq:name=global.retried":   "commands_retried_total",
+	"puppetlabs.puppetdb.mq:name=global.discarded": "commands_discarded_total",
+	"puppetlabs.puppetdb.mq:name=global.fatal":     "commands_fatal_total",
+}
+
+// commandCollector exports the command processing counts read during the
+// latest scrape cycle. They only grow until PuppetDB restarts, so they are
+// exported as counters rather than through the gauges of the reports.
+type commandCollector struct {
+	descs map[string]*prometheus.Desc
+
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+// Describe implements prometheus.Collector
+func (c *commandCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *commandCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, count := range c.counts {
+		ch <- prometheus.MustNewConstMetric(c.descs[name], prometheus.CounterValue, count)
+	}
+}
+
+// set replaces the counts, those which could not be read are no longer
+// exported
+func (c *commandCollector) set(counts map[string]float64) {
+	c.mu.Lock()
+	c.counts = counts
+	c.mu.Unlock()
+}
+
+// checkCommands records the command queue depth and the number of commands
+// processed, retried and given up on since PuppetDB started. The queue depth
+// is already recorded along with the service status when it is exported.
+func (e *Exporter) checkCommands(ctx context.Context) {
+	if !e.options.Status {
+		status, err := e.client.Status(ctx)
+		if err != nil {
+			log.Errorf("failed to get command queue depth: %s", err)
+		} else {
+			e.appendMetric("queue_depth", float64(status.Status.QueueDepth))
+		}
+	}
+
+	mbeans, err := e.client.MBeans(ctx, commandMBeans)
+	if err != nil {
+		log.Errorf("failed to get command processing metrics: %s", err)
+		e.commands.set(nil)
+		return
+	}
+	counts := make(map[string]float64, len(commandMeters))
+	for mbean, name := range commandMeters {
+		if count, ok := mbeans[mbean]["Count"].(float64); ok {
+			counts[name] = count
+		}
+	}
+	e.commands.set(counts)
+}
+
+func (e *Exporter) initCommandGauges() {
+	if !e.options.Status {
+		e.newGauge(e.namespace, "queue_depth", "Number of commands waiting to be processed by PuppetDB", nil)
+	}
+
+	e.commands = &commandCollector{descs: map[string]*prometheus.Desc{
+		"commands_processed_total": prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "", "commands_processed_total"),
+			"Number of commands processed since PuppetDB started", nil, nil),
+		"commands_retried_total": prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "", "commands_retried_total"),
+			"Number of command processing retries since PuppetDB started", nil, nil),
+		"commands_discarded_total": prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "", "commands_discarded_total"),
+			"Number of commands discarded after too many retries since PuppetDB started", nil, nil),
+		"commands_fatal_total": prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "", "commands_fatal_total"),
+			"Number of commands which failed fatally since PuppetDB started", nil, nil),
+	}}
+	e.registry.MustRegister(e.commands)
+}
@@ -0,0 +1,45 @@
+package exporter
+
+import (
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// runDurationQuantiles are the quantiles of the run durations exported by
+// RunDurationQuantiles
+var runDurationQuantiles = []float64{0.5, 0.9, 0.99}
+
+// durationSamples collects the total durations of the latest runs by
+// environment
+type durationSamples map[string][]float64
+
+func (d durationSamples) add(environment string, reportMetrics []puppetdb.ReportMetric) {
+	for _, reportMetric := range reportMetrics {
+		if reportMetric.Category == "time" && reportMetric.Name == "total" {
+			d[environment] = append(d[environment], reportMetric.Value)
+			return
+		}
+	}
+}
+
+// appendRunDurationQuantiles records the quantiles of the run durations of
+// every environment
+func (e *Exporter) appendRunDurationQuantiles(d durationSamples) {
+	for environment, durations := range d {
+		slices.Sort(durations)
+		for _, q := range runDurationQuantiles {
+			labels := e.appendMetric("run_duration_seconds", quantile(durations, q))
+			labels["environment"] = environment
+			labels["quantile"] = strconv.FormatFloat(q, 'g', -1, 64)
+		}
+	}
+}
+
+// quantile returns the q-quantile of the sorted values, by nearest rank
+func quantile(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
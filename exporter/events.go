@@ -0,0 +1,121 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// fetchEvents retrieves the event counts of the latest reports by certname
+func (e *Exporter) fetchEvents(ctx context.Context) (map[string]puppetdb.EventCount, error) {
+	counts, err := e.client.EventCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(map[string]puppetdb.EventCount, len(counts))
+	for _, count := range counts {
+		events[count.Subject.Title] = count
+	}
+	return events, nil
+}
+
+// fetchFailedResources retrieves the failed resources of the latest reports by
+// certname
+func (e *Exporter) fetchFailedResources(ctx context.Context) (map[string][]puppetdb.ResourceEvent, error) {
+	events, err := e.client.FailedResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := map[string][]puppetdb.ResourceEvent{}
+	for _, event := range events {
+		failed[event.Certname] = append(failed[event.Certname], event)
+	}
+	return failed, nil
+}
+
+// logLevels are the log levels counted by the Logs option
+var logLevels = []string{"warning", "err"}
+
+// appendLogs records the log entry counts of a node's latest report
+func (e *Exporter) appendLogs(logs []puppetdb.ReportLog, host, environment string, facts map[string]interface{}) {
+	for _, level := range logLevels {
+		count := 0
+		for _, entry := range logs {
+			if entry.Level == level {
+				count++
+			}
+		}
+
+		labels := e.appendMetric("report_logs", float64(count))
+		labels["environment"] = environment
+		labels["host"] = host
+		labels["level"] = level
+		e.setFactLabels(labels, facts)
+	}
+}
+
+// changeCount counts the changes which remediated drift, and those which
+// applied new configuration
+type changeCount struct {
+	corrective  int
+	intentional int
+}
+
+func (c changeCount) add(o changeCount) changeCount {
+	return changeCount{c.corrective + o.corrective, c.intentional + o.intentional}
+}
+
+// fetchChanges retrieves the change counts of the latest reports by certname
+func (e *Exporter) fetchChanges(ctx context.Context) (map[string]changeCount, error) {
+	counts, err := e.client.ChangeCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]changeCount{}
+	for _, count := range counts {
+		c := changes[count.Certname]
+		if count.CorrectiveChange {
+			c.corrective += count.Count
+		} else {
+			c.intentional += count.Count
+		}
+		changes[count.Certname] = c
+	}
+	return changes, nil
+}
+
+// appendChanges records the change counts of a node's latest report
+func (e *Exporter) appendChanges(count changeCount, host, environment string, facts map[string]interface{}) {
+	labels := e.appendMetric("report_corrective_changes", float64(count.corrective))
+	labels["environment"] = environment
+	labels["host"] = host
+	e.setFactLabels(labels, facts)
+
+	labels = e.appendMetric("report_intentional_changes", float64(count.intentional))
+	labels["environment"] = environment
+	labels["host"] = host
+	e.setFactLabels(labels, facts)
+}
+
+// appendEvents records the event counts of a node's latest report. Reports
+// without events are missing from the event counts, and recorded as zeros.
+func (e *Exporter) appendEvents(count puppetdb.EventCount, host, environment string, facts map[string]interface{}) {
+	for _, result := range []struct {
+		name  string
+		value int
+	}{
+		{"success", count.Successes},
+		{"failure", count.Failures},
+		{"noop", count.Noops},
+		{"skip", count.Skips},
+	} {
+		labels := e.appendMetric("report_event_counts", float64(result.value))
+		labels["environment"] = environment
+		labels["host"] = host
+		labels["result"] = result.name
+		e.setFactLabels(labels, facts)
+	}
+}
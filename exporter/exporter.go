@@ -0,0 +1,1534 @@
+// Package exporter implements the prometheus.Exporter interface, and exports PuppetDB metrics
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/classifier"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/leader"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/puppetserver"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/remotewrite"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/resolver"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// Exporter type
+type Exporter struct {
+	client  puppetdb.Client
+	options *Options
+	// namespace prefixes the metrics of PuppetDB and the exporter,
+	// nodeNamespace the ones of the nodes
+	namespace     string
+	nodeNamespace string
+	metrics       map[string]*prometheus.GaugeVec
+	// fqNames maps the keys of metrics to the full metric names
+	fqNames map[string]string
+	// labelSources maps the keys of the metrics to the labels their label
+	// values are taken from, in label name order, which differ from the
+	// label names of relabeled metrics
+	labelSources map[string][]string
+	// published tracks the series of the metrics by key
+	published map[string]*seriesSet
+	// factLabels are the names of the labels holding FactLabels
+	factLabels []string
+	// categoryLabels are the label names of the report metrics of the
+	// categories
+	categoryLabels []string
+	// discovered are the categories found in the reports of the cycle whose
+	// gauges are not created yet, autoCategories those whose gauges were
+	discovered     []string
+	autoCategories []string
+
+	// failover is set when PE replicas are configured, activeURL is the URL
+	// of the PuppetDB queried during the latest cycle
+	failover  bool
+	activeURL string
+
+	audit *seriesAudit
+	sd    *discovery
+	// sdFile is the content of SDFile written during a previous cycle
+	sdFile []byte
+	// restored is set while the metrics restored by LoadState are served
+	restored bool
+	// snapshot is the node list kept across cycles with FullRefreshInterval
+	// or ConditionalRequests
+	snapshot *nodeSnapshot
+	// lastFacts are the facts of the previous cycle, reused when the facts
+	// query fails, or along with the responses they were derived from with
+	// ConditionalRequests
+	lastFacts nodeFacts
+	// limitExceeded is set while the series limits are exceeded
+	limitExceeded bool
+	// ready is set while the latest scrape cycle succeeded, started is
+	// closed once the first one did
+	ready     atomic.Bool
+	started   chan struct{}
+	startOnce sync.Once
+	// isLeader is the value of the leader gauge, -1 before the first
+	// election
+	isLeader float64
+	last     lastScrape
+
+	stageDuration     *prometheus.GaugeVec
+	effectiveInterval prometheus.Gauge
+	restoredTime      prometheus.Gauge
+	scrapeTimeouts    prometheus.Counter
+	seriesLimit       prometheus.Gauge
+	leader            prometheus.Gauge
+	reportAge         *snapshotBuckets
+	jmx               *jmxCollector
+	// registry registers the metrics, gaugeErr is the first error met
+	// creating the gauges
+	registry prometheus.Registerer
+	gaugeErr error
+	commands *commandCollector
+
+	// labels interns label values, names caches the formatted report metric
+	// names, categories the metric names of the report categories, and
+	// reports keeps the per-cycle metrics so that their slices and label
+	// maps are reused from one cycle to the next. Each interner caches a
+	// single transform, the same input giving different results in each.
+	labels     *interner
+	names      *interner
+	categories *interner
+	hosts      *interner
+	reports    map[string][]metric
+}
+
+// Options contains the options of the exporter
+type Options struct {
+	// Categories are the report metrics categories to export
+	Categories map[string]struct{}
+	// AutoCategories exports the categories found in the reports along with
+	// Categories, except ExcludeCategories
+	AutoCategories    bool
+	ExcludeCategories []string
+	// CategoryLabels restricts the labels of the report metrics of the
+	// categories to the name label and the given ones, e.g. host
+	CategoryLabels []string
+	// ReportMetrics restricts the metrics exported of the categories it
+	// holds to the given names, e.g. total for the time category
+	ReportMetrics map[string]map[string]struct{}
+	// RawReportMetricNames exports the report metric names as found in the
+	// reports, e.g. config_retrieval rather than Config retrieval
+	RawReportMetricNames bool
+	// CatalogResources are the resources whose nodes are counted
+	CatalogResources []CatalogResource
+	// Queries are user-defined queries exported as gauges
+	Queries []Query
+	// Namespace prefixes the puppet and puppetdb namespaces of the metrics
+	Namespace string
+	// ProblemNodesOnly restricts the per-host report metrics to failed,
+	// changed and unreported nodes
+	ProblemNodesOnly bool
+	// AggregateOnly drops every per-host metric, only the counts and sums
+	// across nodes are exported
+	AggregateOnly bool
+	// CertnameInclude and CertnameExclude restrict the exported nodes to
+	// the certnames matching, or not matching, the expressions
+	CertnameInclude *regexp.Regexp
+	CertnameExclude *regexp.Regexp
+	// DropLabels are removed from the published metrics, RenameLabels maps
+	// labels to the names they are published under
+	DropLabels   []string
+	RenameLabels map[string]string
+	// MaxSeries and MaxSeriesPerMetric bound the number of series in total
+	// and of each per-host metric, the per-host metrics are dropped while
+	// either is exceeded. Unbounded when 0.
+	MaxSeries          int
+	MaxSeriesPerMetric int
+	// ScrapeTimeout bounds the duration of a scrape cycle, unbounded when 0
+	ScrapeTimeout time.Duration
+	// Splay is the window within which the start of each cycle is randomly
+	// delayed
+	Splay time.Duration
+	// FullRefreshInterval is the interval between two fetches of every node,
+	// in between only the nodes which changed are fetched and the metrics of
+	// unchanged reports are reused. Every node is fetched each cycle when 0.
+	FullRefreshInterval time.Duration
+	// ConditionalRequests keeps the metrics of the latest report of every
+	// node and the facts across cycles, the former being reused while the
+	// report is unchanged and the latter while the client reuses the
+	// responses of the facts queries after conditional requests
+	ConditionalRequests bool
+	// IncrementalOverlap is subtracted from the start of the previous query
+	// when fetching the changed nodes, to make up for the delay between the
+	// time a command is produced, which the nodes are filtered on, and the
+	// time PuppetDB stores it. 10 minutes when unset.
+	IncrementalOverlap time.Duration
+	// ShardIndex and ShardTotal restrict the exported nodes to the ones whose
+	// certname hashes to ShardIndex modulo ShardTotal
+	ShardIndex int
+	ShardTotal int
+	// ExcludeInactive drops deactivated and expired nodes from the per-node
+	// metrics, ExcludeInactiveCounts from the status counts
+	ExcludeInactive       bool
+	ExcludeInactiveCounts bool
+	// HostMapper turns certnames into host label values, they are used as
+	// is when nil
+	HostMapper *HostMapper
+	// SilenceFact is a boolean fact set on nodes which opt out of status
+	// counts and per-node metrics, which are then counted as silenced
+	SilenceFact string
+	// ThresholdFact is a fact holding a node's own unreported duration
+	ThresholdFact string
+	// ThresholdOverrides set the unreported duration of the nodes lacking
+	// ThresholdFact by the value of a fact
+	ThresholdOverrides []ThresholdOverride
+	// FactMetrics are numeric facts exported as puppet_fact_<name> gauges
+	FactMetrics []string
+	// FactLabels are facts attached as labels to the per-node metrics
+	FactLabels []string
+	// AutoTune adjusts the scrape interval when cycles consistently take more
+	// than AutoTuneFraction of it
+	AutoTune         bool
+	AutoTuneFraction float64
+	// SeriesAudit checks the consistency of the published series after each
+	// cycle, see AuditHandler
+	SeriesAudit bool
+	// AgentVersions counts the nodes by Puppet agent version
+	AgentVersions bool
+	// OSVersions counts the nodes by operating system family and release
+	OSVersions bool
+	// Resources exports the resource counts of the latest reports with the
+	// fixed set of states in resourceStates, in place of the resources
+	// category
+	Resources bool
+	// ResourceTotals exports the resource counts summed across the latest
+	// reports of every node, per environment with ResourceTotalsByEnvironment
+	ResourceTotals              bool
+	ResourceTotalsByEnvironment bool
+	// NodeStatus exports the status of every node as a 0/1 enum
+	NodeStatus bool
+	// NodeInfo exports the environment, agent version and operating system
+	// of every node as puppet_node_info, to be joined in queries
+	NodeInfo bool
+	// RunDurationQuantiles exports the quantiles of the durations of the
+	// latest runs by environment
+	RunDurationQuantiles bool
+	// Events exports the event counts of the latest reports
+	Events bool
+	// Changes exports the corrective and intentional changes of the latest
+	// reports, per node and per environment
+	Changes bool
+	// Logs exports the warning and error log entry counts of the latest
+	// reports
+	Logs bool
+	// FailedResources exports the resources which failed in the latest
+	// reports, up to FailedResourcesLimit series
+	FailedResources      bool
+	FailedResourcesLimit int
+	// ReportAgeBuckets are the upper bounds in seconds of the buckets the
+	// active nodes are counted in by report age
+	ReportAgeBuckets []float64
+	// ReportTimestamps exports the puppet_report samples with the report
+	// time as sample timestamp
+	ReportTimestamps bool
+	// FlappingReports is the number of latest reports of each node checked
+	// for flapping, which is disabled when 0. Nodes are flapping when at
+	// least FlappingThreshold of them changed or failed.
+	FlappingReports   int
+	FlappingThreshold int
+	// Producers counts the nodes by Puppet Server which compiled their
+	// latest catalog, and status
+	Producers bool
+	// Status exports the status of the PuppetDB service
+	Status bool
+	// JMXMBeans are the object name patterns of the MBeans read from the
+	// metrics API and exported as puppetdb_jmx_* metrics
+	JMXMBeans []string
+	// Commands exports the command queue depth and processing counts
+	Commands bool
+	// Population exports the population summary of PuppetDB
+	Population bool
+	// PuppetServer is the Puppet Server whose status is exported, if any
+	PuppetServer *puppetserver.PuppetServer
+	// CA exports the certificates of the Puppet CA of PuppetServer
+	CA bool
+	// Classifier is the PE node classifier whose groups nodes are pinned to
+	// are attached to the per-node metrics as the node_groups label, if any
+	Classifier *classifier.Classifier
+	// CodeManager is the PE Code Manager whose deployments are exported, if
+	// any
+	CodeManager *puppetserver.PuppetServer
+	// Patching exports the update counts and reboot flag of the pe_patch or
+	// os_patching facts
+	Patching bool
+	// Packages exports the number of packages installed on each node, and
+	// the versions of the PackageVersions packages
+	Packages        bool
+	PackageVersions []string
+	// SD builds Prometheus service discovery targets from the active nodes,
+	// see SDHandler. SDPort is appended to the certnames when set, and the
+	// SDFacts are attached as __meta_puppetdb_fact_<name> labels.
+	SD      bool
+	SDPort  int
+	SDFacts []string
+	// SDFile is the file_sd file the active nodes are written to, with the
+	// facts of SDFileLabels as labels of the given names
+	SDFile       string
+	SDFileLabels map[string]string
+	// StateFile is the file the metrics are saved to after each successful
+	// scrape cycle, and restored from by LoadState
+	StateFile string
+	// Pusher pushes the metrics to a Pushgateway after each scrape cycle
+	Pusher *push.Pusher
+	// RemoteWrite pushes the metrics to a remote write endpoint after each
+	// scrape cycle
+	RemoteWrite *remotewrite.Client
+	// Lock elects the instance which scrapes PuppetDB among the ones sharing
+	// it, the other ones only serve the exporter metrics
+	Lock *leader.Lock
+	// Resolver discovers the PuppetDB servers before each cycle, which then
+	// replace the configured URLs
+	Resolver resolver.Resolver
+	// Client replaces the PuppetDB client created from the client options,
+	// e.g. with a fake in tests
+	Client puppetdb.Client
+	// Registerer registers the metrics of the exporter instead of the
+	// default registerer, e.g. to run several exporters in tests
+	Registerer prometheus.Registerer
+}
+
+// envStatus identifies the nodes of an environment with the same status
+type envStatus struct {
+	environment string
+	status      string
+}
+
+type metric struct {
+	labels prometheus.Labels
+	value  float64
+}
+
+// Node statuses assigned by the exporter rather than reported by Puppet
+const (
+	StatusUnreported  = "unreported"
+	StatusDeactivated = "deactivated"
+	StatusExpired     = "expired"
+	StatusSilenced    = "silenced"
+)
+
+// nodeStatuses are the statuses of the puppet_node_status enum, every one of
+// them being exported for each node so that its series stay stable
+var nodeStatuses = []string{"changed", "unchanged", "failed", StatusUnreported, StatusDeactivated, StatusExpired}
+
+// internMaxEntries bounds the number of strings held by each interner
+const internMaxEntries = 1 << 16
+
+var (
+	metricMap = map[string]string{
+		"node_status_count": "node_status_count",
+	}
+
+	// runDurations maps the time report metrics exported whatever the
+	// enabled categories to their gauges
+	runDurations = map[string]string{
+		"total":            "report_time_total",
+		"config_retrieval": "report_time_config_retrieval",
+	}
+)
+
+// NewPuppetDBExporter returns a new exporter of PuppetDB metrics.
+func NewPuppetDBExporter(clientOpts *puppetdb.Options, opts *Options) (*Exporter, error) {
+	client := opts.Client
+	if client == nil {
+		var err error
+		client, err = puppetdb.NewClient(clientOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new client: %s", err)
+		}
+	}
+	return newExporter(client, len(clientOpts.ReplicaURLs) > 0 || opts.Resolver != nil, opts)
+}
+
+// CheckOptions returns the error NewPuppetDBExporter would return for the
+// exporter options, without creating a client nor registering any metric.
+// The options are left unchanged.
+func CheckOptions(opts *Options) error {
+	o := *opts
+	o.Categories = maps.Clone(opts.Categories)
+	o.ExcludeCategories = slices.Clone(opts.ExcludeCategories)
+	o.Registerer = prometheus.NewRegistry()
+	_, err := newExporter(nil, false, &o)
+	return err
+}
+
+// newExporter returns an exporter querying PuppetDB through client
+func newExporter(client puppetdb.Client, failover bool, opts *Options) (e *Exporter, err error) {
+	if opts.Namespace != "" && !model.IsValidMetricName(model.LabelValue(opts.Namespace)) {
+		return nil, fmt.Errorf("invalid metrics namespace %q", opts.Namespace)
+	}
+
+	e = &Exporter{
+		client:        client,
+		options:       opts,
+		namespace:     namespace(opts.Namespace, "puppetdb"),
+		nodeNamespace: namespace(opts.Namespace, "puppet"),
+		failover:      failover,
+		labels:        newInterner(internMaxEntries),
+		names:         newInterner(internMaxEntries),
+		categories:    newInterner(internMaxEntries),
+		hosts:         newInterner(internMaxEntries),
+		reports:       map[string][]metric{},
+		isLeader:      -1,
+		started:       make(chan struct{}),
+		published:     map[string]*seriesSet{},
+		registry:      opts.Registerer,
+	}
+	if e.registry == nil {
+		e.registry = prometheus.DefaultRegisterer
+	}
+
+	if opts.SeriesAudit {
+		e.audit = &seriesAudit{}
+	}
+	if opts.SD {
+		e.sd = &discovery{}
+	}
+
+	if _, ok := opts.Categories["resources"]; ok && opts.Resources {
+		log.Info("resources category replaced by the resource counts")
+		delete(opts.Categories, "resources")
+	}
+	if opts.AutoCategories && opts.Resources {
+		opts.ExcludeCategories = append(opts.ExcludeCategories, "resources")
+	}
+
+	e.factLabels, err = factLabelNames(opts.FactLabels, []string{"name", "environment", "host", "deactivated", "status", "reason", "state", "result", "level", "node_groups"})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Classifier != nil {
+		e.factLabels = append(e.factLabels, "node_groups")
+	}
+	e.categoryLabels, err = categoryLabelNames(e.factLabels, opts.CategoryLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.initGauges(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// namespace returns the namespace of metrics prefixed with prefix, if any
+func namespace(prefix, namespace string) string {
+	if prefix == "" {
+		return namespace
+	}
+	return prefix + "_" + namespace
+}
+
+// Describe outputs PuppetDB metric descriptions
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range e.metrics {
+		m.Describe(ch)
+	}
+}
+
+// Collect fetches new metrics from the PuppetDB and updates the appropriate metrics
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range e.metrics {
+		m.Collect(ch)
+	}
+}
+
+// Scrape scrapes PuppetDB and update metrics
+func (e *Exporter) Scrape(interval time.Duration, unreportedNode string, verbose bool) {
+	unreportedDuration, err := time.ParseDuration(unreportedNode)
+	if err != nil {
+		log.Errorf("failed to parse unreported duration: %s", err)
+		return
+	}
+
+	var tuner *intervalTuner
+	if e.options.AutoTune {
+		tuner = newIntervalTuner(interval, e.options.AutoTuneFraction)
+	}
+
+	time.Sleep(e.splay())
+	for {
+		if !e.leading() {
+			e.setReady(true)
+			time.Sleep(interval + e.splay())
+			continue
+		}
+
+		start := time.Now()
+		ctx, cancel := e.cycleContext()
+		err := e.scrape(ctx, unreportedDuration, verbose)
+		cancel()
+		e.setReady(err == nil)
+		if err == nil && e.options.StateFile != "" {
+			if err := e.saveState(); err != nil {
+				log.Errorf("failed to save state: %s", err)
+			}
+		}
+		e.push()
+
+		if tuner != nil {
+			interval = tuner.observe(time.Since(start))
+		}
+		e.effectiveInterval.Set(interval.Seconds())
+
+		time.Sleep(interval + e.splay())
+	}
+}
+
+// splay returns a random delay shorter than Splay, added before each cycle
+func (e *Exporter) splay() time.Duration {
+	if e.options.Splay <= 0 {
+		return 0
+	}
+	return rand.N(e.options.Splay)
+}
+
+// Once runs a single scrape cycle, and returns an error when PuppetDB could
+// not be scraped
+func (e *Exporter) Once(unreportedNode string, verbose bool) error {
+	unreportedDuration, err := time.ParseDuration(unreportedNode)
+	if err != nil {
+		return fmt.Errorf("failed to parse unreported duration: %s", err)
+	}
+
+	ctx, cancel := e.cycleContext()
+	defer cancel()
+
+	err = e.scrape(ctx, unreportedDuration, verbose)
+	e.push()
+	return err
+}
+
+// cycleContext returns the context of a scrape cycle, bounded by
+// ScrapeTimeout
+func (e *Exporter) cycleContext() (context.Context, context.CancelFunc) {
+	if e.options.ScrapeTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), e.options.ScrapeTimeout)
+}
+
+// leading reports whether the exporter is the elected instance, which is
+// always the case without Lock
+func (e *Exporter) leading() bool {
+	if e.options.Lock == nil {
+		return true
+	}
+
+	ok, err := e.options.Lock.TryAcquire()
+	if err != nil {
+		log.Errorf("failed to acquire leader lock: %s", err)
+	}
+
+	if ok && e.isLeader != 1 {
+		log.Info("elected leader, scraping PuppetDB")
+	} else if !ok && e.isLeader == -1 {
+		log.Info("standing by while another instance is the leader")
+	}
+	e.isLeader = boolValue(ok)
+	e.leader.Set(e.isLeader)
+	return ok
+}
+
+// push sends the metrics to the configured Pushgateway and remote write
+// endpoint
+func (e *Exporter) push() {
+	if e.options.Pusher != nil {
+		if err := e.options.Pusher.Push(); err != nil {
+			log.Errorf("failed to push metrics: %s", err)
+		}
+	}
+	if e.options.RemoteWrite != nil {
+		if err := e.options.RemoteWrite.Push(context.Background()); err != nil {
+			log.Errorf("failed to remote write metrics: %s", err)
+		}
+	}
+}
+
+// stageTimer accumulates the time spent in each stage of a scrape cycle
+type stageTimer map[string]time.Duration
+
+// since adds the time elapsed since start to the stage
+func (t stageTimer) since(stage string, start time.Time) {
+	t[stage] += time.Since(start)
+}
+
+// scrape runs a single scrape cycle, the returned error is set when the nodes
+// could not be fetched, other failures being only logged
+func (e *Exporter) scrape(ctx context.Context, unreportedDuration time.Duration, verbose bool) (scrapeErr error) {
+	const debugStr = "Node: %s / Unreported Reason: %s\n"
+
+	statuses := make(map[string]int)
+	envStatuses := make(map[envStatus]int)
+	versions := make(map[string]int)
+	staleCatalogs := 0
+	noopNodes := 0
+	deactivatedNodes, expiredNodes := 0, 0
+	flappingNodes := 0
+	cachedCatalogs := map[string]int{"explicitly_requested": 0, "on_failure": 0}
+	totals := resourceTotals{}
+	durations := durationSamples{}
+	systems := make(map[osKey]int)
+	timer := stageTimer{}
+	summary := ScrapeSummary{
+		Time:       time.Now(),
+		Unreported: []UnreportedNode{},
+		Errors:     []string{},
+	}
+	fail := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Error(msg)
+		summary.Errors = append(summary.Errors, msg)
+	}
+
+	for k, ms := range e.reports {
+		e.reports[k] = ms[:0]
+	}
+
+	if e.failover {
+		start := time.Now()
+		if e.options.Resolver != nil {
+			e.resolveServers(ctx)
+		}
+		e.checkReplicas(ctx)
+		timer.since("status", start)
+	}
+	start := time.Now()
+	e.checkVersion(ctx)
+	if e.options.Status {
+		e.checkStatus(ctx)
+	}
+	timer.since("status", start)
+	if e.options.Commands {
+		start := time.Now()
+		e.checkCommands(ctx)
+		timer.since("status", start)
+	}
+	if e.options.Population {
+		start := time.Now()
+		e.checkPopulation(ctx)
+		timer.since("status", start)
+	}
+	if e.options.PuppetServer != nil {
+		start := time.Now()
+		e.checkPuppetServer(ctx)
+		if e.options.CA {
+			e.checkCA(ctx)
+		}
+		timer.since("puppetserver", start)
+	}
+	if e.options.CodeManager != nil {
+		start := time.Now()
+		e.checkCodeManager(ctx)
+		timer.since("puppetserver", start)
+	}
+	if e.jmx != nil {
+		start := time.Now()
+		e.collectJMX(ctx)
+		timer.since("jmx", start)
+	}
+	if len(e.options.CatalogResources) > 0 {
+		start := time.Now()
+		if err := e.countCatalogResources(ctx); err != nil {
+			fail("failed to count catalog resources: %s", err)
+		}
+		timer.since("catalogs", start)
+	}
+	if len(e.options.Queries) > 0 {
+		start := time.Now()
+		if err := e.runQueries(ctx); err != nil {
+			fail("failed to run queries: %s", err)
+		}
+		timer.since("queries", start)
+	}
+
+	start = time.Now()
+	nodes, err := e.fetchNodes(ctx)
+	if err != nil {
+		fail("failed to get nodes: %s", err)
+		scrapeErr = err
+	}
+	timer.since("nodes", start)
+
+	start = time.Now()
+	facts, err := e.fetchFacts(ctx)
+	if err != nil {
+		fail("failed to get facts: %s", err)
+		// Without the facts, the silenced nodes and the unreported
+		// thresholds set by facts would be lost for the cycle, so the facts
+		// of the previous cycle are used, or the cycle aborted if none
+		if e.lastFacts == nil {
+			return fmt.Errorf("scrape cycle aborted: failed to get facts: %s", err)
+		}
+		log.Warn("using the facts of the previous scrape cycle")
+		facts = e.lastFacts
+	}
+	timer.since("facts", start)
+
+	if e.options.Classifier != nil {
+		start = time.Now()
+		if facts == nil {
+			facts = nodeFacts{}
+		}
+		e.fetchNodeGroups(ctx, facts)
+		timer.since("classifier", start)
+	}
+
+	var events map[string]puppetdb.EventCount
+	if e.options.Events {
+		start = time.Now()
+		events, err = e.fetchEvents(ctx)
+		if err != nil {
+			fail("failed to get events: %s", err)
+		}
+		timer.since("events", start)
+	}
+
+	var changes map[string]changeCount
+	if e.options.Changes {
+		start = time.Now()
+		changes, err = e.fetchChanges(ctx)
+		if err != nil {
+			fail("failed to get changes: %s", err)
+		}
+		timer.since("events", start)
+	}
+	changeTotals := map[string]changeCount{}
+
+	var failed map[string][]puppetdb.ResourceEvent
+	if e.options.FailedResources {
+		start = time.Now()
+		failed, err = e.fetchFailedResources(ctx)
+		if err != nil {
+			fail("failed to get failed resources: %s", err)
+		}
+		timer.since("events", start)
+	}
+	failedSeries, failedDropped := 0, 0
+
+	var producers map[string]string
+	if e.options.Producers {
+		start = time.Now()
+		producers, err = e.fetchProducers(ctx)
+		if err != nil {
+			fail("failed to get report producers: %s", err)
+		}
+		timer.since("producers", start)
+	}
+	producerStatuses := map[producerStatus]int{}
+	reportAges := e.reportAge.cycle()
+
+	var packages map[string]*nodePackages
+	if e.options.Packages {
+		start = time.Now()
+		packages, err = e.fetchPackages(ctx)
+		if err != nil {
+			fail("failed to get package inventory: %s", err)
+		}
+		timer.since("facts", start)
+	}
+
+	start = time.Now()
+	for _, node := range nodes {
+		if ctx.Err() != nil {
+			break
+		}
+		if !e.included(node.Certname) {
+			continue
+		}
+		summary.Nodes++
+
+		// Inactive nodes are counted whatever ExcludeInactiveCounts
+		if node.Deactivated != "" {
+			deactivatedNodes++
+		} else if node.Expired != "" {
+			expiredNodes++
+		}
+
+		if e.silenced(facts[node.Certname]) {
+			statuses[StatusSilenced]++
+			envStatuses[envStatus{node.ReportEnvironment, StatusSilenced}]++
+			continue
+		}
+
+		// This doesn't matter too much for unreported status
+		deactivated := "false"
+		if node.Deactivated != "" {
+			deactivated = "true"
+		}
+
+		threshold := e.unreportedThreshold(node.Certname, facts[node.Certname], unreportedDuration)
+		statusStr, reasonStr, latestReport := NodeStatus(node, threshold)
+		if statusStr == StatusUnreported {
+			if verbose {
+				log.Debugf(debugStr, node.Certname, reasonStr)
+			}
+
+			unreported := UnreportedNode{
+				Certname:    node.Certname,
+				Host:        e.host(node.Certname),
+				Environment: node.ReportEnvironment,
+				Reason:      reasonStr,
+			}
+			if !latestReport.IsZero() {
+				unreported.LatestReport = &latestReport
+			}
+			summary.Unreported = append(summary.Unreported, unreported)
+		}
+
+		inactive := node.Deactivated != "" || node.Expired != ""
+		if !inactive || !e.options.ExcludeInactiveCounts {
+			statuses[statusStr]++
+			envStatuses[envStatus{node.ReportEnvironment, statusStr}]++
+			if producers != nil {
+				producer := producers[node.Certname]
+				if producer == "" {
+					producer = unknownValue
+				}
+				producerStatuses[producerStatus{producer, statusStr}]++
+			}
+			if node.LatestReportNoop {
+				noopNodes++
+			}
+			if node.CachedCatalogStatus != "" && node.CachedCatalogStatus != "not_used" {
+				cachedCatalogs[node.CachedCatalogStatus]++
+			}
+			if e.options.AgentVersions {
+				versions[agentVersion(facts[node.Certname])]++
+			}
+			if e.options.OSVersions {
+				systems[osVersion(facts[node.Certname])]++
+			}
+		}
+		if inactive && e.options.ExcludeInactive {
+			continue
+		}
+		if !inactive && !latestReport.IsZero() {
+			e.reportAge.observe(reportAges, time.Since(latestReport).Seconds())
+		}
+
+		host := e.host(node.Certname)
+		environment := e.labels.intern(node.ReportEnvironment)
+		statusStr = e.labels.intern(statusStr)
+		reasonStr = e.labels.intern(reasonStr)
+
+		labels := e.appendMetric("report", float64(latestReport.Unix()))
+		labels["environment"] = environment
+		labels["host"] = host
+		labels["deactivated"] = deactivated
+		labels["status"] = statusStr
+		e.setFactLabels(labels, facts[node.Certname])
+
+		if e.options.NodeStatus {
+			e.appendNodeStatus(host, statusStr)
+		}
+		if e.options.NodeInfo {
+			e.appendNodeInfo(host, environment, deactivated, facts[node.Certname])
+		}
+
+		// The reason is kept apart so that the report series do not
+		// change when it does
+		if reasonStr != "" {
+			labels := e.appendMetric("report_unreported_info", 1)
+			labels["host"] = host
+			labels["reason"] = reasonStr
+		}
+
+		if node.LatestReportHash != "" {
+			var noop float64
+			if node.LatestReportNoop {
+				noop = 1
+			}
+			labels := e.appendMetric("report_noop", noop)
+			labels["environment"] = environment
+			labels["host"] = host
+			e.setFactLabels(labels, facts[node.Certname])
+		}
+
+		if factsTimestamp, err := ParseTimestamp(node.FactsTimestamp); err == nil {
+			labels := e.appendMetric("facts_timestamp", float64(factsTimestamp.Unix()))
+			labels["environment"] = environment
+			labels["host"] = host
+			e.setFactLabels(labels, facts[node.Certname])
+		}
+
+		if catalogTimestamp, err := ParseTimestamp(node.CatalogTimestamp); err == nil {
+			labels := e.appendMetric("catalog_timestamp", float64(catalogTimestamp.Unix()))
+			labels["environment"] = environment
+			labels["host"] = host
+			e.setFactLabels(labels, facts[node.Certname])
+
+			if !inactive && catalogTimestamp.Add(threshold).Before(time.Now()) {
+				staleCatalogs++
+			}
+		}
+
+		e.appendFactMetrics(facts[node.Certname], host, environment)
+		if e.options.Patching {
+			e.appendPatching(facts[node.Certname], host, environment)
+		}
+		if inventory := packages[node.Certname]; inventory != nil {
+			e.appendPackages(inventory, host, environment, facts[node.Certname])
+		}
+
+		// The fleet totals need the reports of every node, even those
+		// without per-node report metrics
+		perNode := !e.options.AggregateOnly && (!e.options.ProblemNodesOnly || problemStatus(statusStr))
+
+		if events != nil && node.LatestReportHash != "" && perNode {
+			e.appendEvents(events[node.Certname], host, environment, facts[node.Certname])
+		}
+		if e.options.FlappingReports > 0 && !inactive && node.LatestReportHash != "" {
+			flappingStart := time.Now()
+			flapping, err := e.flapping(ctx, node.Certname)
+			timer.since("reports", flappingStart)
+			if err != nil {
+				fail("failed to check flapping of %s: %s", node.Certname, err)
+			} else {
+				if flapping {
+					flappingNodes++
+				}
+				if perNode {
+					e.appendFlapping(flapping, host, environment, facts[node.Certname])
+				}
+			}
+		}
+		if e.options.Logs && node.LatestReportHash != "" && perNode {
+			logsStart := time.Now()
+			logs, err := e.client.ReportLogs(ctx, node.LatestReportHash)
+			timer.since("reports", logsStart)
+			if err != nil {
+				fail("failed to get logs of %s: %s", node.Certname, err)
+			} else {
+				e.appendLogs(logs, host, environment, facts[node.Certname])
+			}
+		}
+		if perNode {
+			for _, event := range failed[node.Certname] {
+				if failedSeries >= e.options.FailedResourcesLimit {
+					failedDropped++
+					continue
+				}
+				failedSeries++
+
+				labels := e.appendMetric("failed_resource", 1)
+				labels["environment"] = environment
+				labels["host"] = host
+				labels["resource_type"] = e.labels.intern(event.ResourceType)
+				labels["resource_title"] = event.ResourceTitle
+			}
+		}
+		if changes != nil && node.LatestReportHash != "" {
+			count := changes[node.Certname]
+			changeTotals[environment] = changeTotals[environment].add(count)
+			if perNode {
+				e.appendChanges(count, host, environment, facts[node.Certname])
+			}
+		}
+		if node.LatestReportHash != "" && (perNode || e.options.ResourceTotals || e.options.RunDurationQuantiles) {
+			reportStart := time.Now()
+			reportMetrics, _ := e.reportMetrics(ctx, node)
+			timer.since("reports", reportStart)
+
+			if e.options.ResourceTotals {
+				totalsEnvironment := ""
+				if e.options.ResourceTotalsByEnvironment {
+					totalsEnvironment = environment
+				}
+				totals.add(totalsEnvironment, reportMetrics)
+			}
+			if e.options.RunDurationQuantiles {
+				durations.add(environment, reportMetrics)
+			}
+			if !perNode {
+				continue
+			}
+
+			if e.options.Resources && len(reportMetrics) > 0 {
+				e.appendResources(reportMetrics, host, environment, facts[node.Certname])
+			}
+
+			for _, reportMetric := range reportMetrics {
+				if name, ok := runDurations[reportMetric.Name]; ok && reportMetric.Category == "time" {
+					labels := e.appendMetric(name, reportMetric.Value)
+					labels["environment"] = environment
+					labels["host"] = host
+					e.setFactLabels(labels, facts[node.Certname])
+				}
+
+				if e.exportCategory(reportMetric.Category) && e.exportReportMetric(reportMetric.Category, reportMetric.Name) {
+					category := e.categories.transform(reportMetric.Category, func(s string) string {
+						return fmt.Sprintf("report_%s", s)
+					})
+					labels := e.appendMetric(category, reportMetric.Value)
+					labels["name"] = e.reportMetricName(reportMetric.Name)
+					labels["environment"] = environment
+					labels["deactivated"] = deactivated
+					labels["host"] = host
+					labels["status"] = statusStr
+					e.setFactLabels(labels, facts[node.Certname])
+				}
+			}
+		}
+	}
+	e.addCategories()
+
+	// An aborted cycle keeps the metrics of the previous one
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			e.scrapeTimeouts.Inc()
+		}
+		log.Errorf("scrape cycle aborted: %s", err)
+		return fmt.Errorf("scrape cycle aborted: %s", err)
+	}
+
+	for statusName, statusValue := range statuses {
+		labels := e.appendMetric("node_report_status_count", float64(statusValue))
+		labels["status"] = statusName
+	}
+	for key, count := range envStatuses {
+		labels := e.appendMetric("node_report_status_by_environment_count", float64(count))
+		labels["environment"] = e.labels.intern(key.environment)
+		labels["status"] = e.labels.intern(key.status)
+	}
+	e.appendMetric("stale_catalog_count", float64(staleCatalogs))
+	e.appendMetric("nodes_noop_count", float64(noopNodes))
+	e.appendMetric("nodes_deactivated_count", float64(deactivatedNodes))
+	e.appendMetric("nodes_expired_count", float64(expiredNodes))
+	if e.options.FlappingReports > 0 {
+		e.appendMetric("nodes_flapping_count", float64(flappingNodes))
+	}
+	for reason, count := range cachedCatalogs {
+		labels := e.appendMetric("nodes_cached_catalog_count", float64(count))
+		labels["reason"] = e.labels.intern(reason)
+	}
+	if e.options.ResourceTotals {
+		e.appendResourceTotals(totals)
+	}
+	if e.options.RunDurationQuantiles {
+		e.appendRunDurationQuantiles(durations)
+	}
+	if e.options.FailedResources {
+		if failedDropped > 0 {
+			log.Debugf("%d failed resources not exported, over the limit of %d", failedDropped, e.options.FailedResourcesLimit)
+		}
+		e.appendMetric("failed_resources_dropped", float64(failedDropped))
+	}
+	for environment, count := range changeTotals {
+		labels := e.appendMetric("corrective_changes_by_environment", float64(count.corrective))
+		labels["environment"] = environment
+		labels = e.appendMetric("intentional_changes_by_environment", float64(count.intentional))
+		labels["environment"] = environment
+	}
+	for key, count := range producerStatuses {
+		labels := e.appendMetric("nodes_by_producer", float64(count))
+		labels["producer"] = e.labels.intern(key.producer)
+		labels["status"] = e.labels.intern(key.status)
+	}
+	for version, count := range versions {
+		labels := e.appendMetric("nodes_by_agent_version", float64(count))
+		labels["version"] = e.labels.intern(version)
+	}
+	for system, count := range systems {
+		labels := e.appendMetric("nodes_by_os", float64(count))
+		labels["family"] = e.labels.intern(system.family)
+		labels["release"] = e.labels.intern(system.release)
+	}
+	if e.sd != nil && nodes != nil {
+		e.updateTargets(nodes, facts)
+	}
+	if e.options.SDFile != "" && nodes != nil {
+		if err := e.writeTargetsFile(nodes, facts); err != nil {
+			fail("failed to write service discovery file: %s", err)
+		}
+	}
+	// The reports are fetched node by node within the build stage
+	timer.since("build", start)
+	timer["build"] -= timer["reports"]
+
+	start = time.Now()
+	if e.audit != nil {
+		e.audit.check(e.reports, e.fqNames)
+	}
+
+	e.reportAge.publish(reportAges)
+	// The restored metrics are served until a cycle fetches the nodes
+	if !e.restored || scrapeErr == nil {
+		e.publishReports(e.options.AggregateOnly || e.seriesLimitExceeded())
+		e.restored = false
+		e.restoredTime.Set(0)
+	}
+	timer.since("publish", start)
+
+	summary.Stages = make(map[string]float64, len(timer))
+	for stage, d := range timer {
+		e.stageDuration.WithLabelValues(stage).Set(d.Seconds())
+		summary.Stages[stage] = d.Seconds()
+	}
+
+	summary.Statuses = statuses
+	summary.Duration = time.Since(summary.Time).Seconds()
+	e.last.set(summary)
+	return
+}
+
+// resolveServers replaces the PuppetDB servers by the resolved ones, the
+// previous ones being kept when the resolution fails
+func (e *Exporter) resolveServers(ctx context.Context) {
+	urls, err := e.options.Resolver.Resolve(ctx)
+	if err == nil && len(urls) == 0 {
+		err = fmt.Errorf("no PuppetDB server found")
+	}
+	if err != nil {
+		log.Errorf("failed to resolve PuppetDB servers: %s", err)
+		return
+	}
+
+	if slices.Equal(urls, e.client.URLs()) {
+		return
+	}
+	if err := e.client.SetURLs(urls); err != nil {
+		log.Errorf("failed to set PuppetDB servers: %s", err)
+		return
+	}
+	log.Infof("PuppetDB servers: %s", strings.Join(urls, ", "))
+}
+
+// checkReplicas directs queries to the active PE primary and records the
+// status of every PuppetDB server
+func (e *Exporter) checkReplicas(ctx context.Context) {
+	for _, status := range e.client.Failover(ctx) {
+		role := "replica"
+		if status.Primary {
+			role = "primary"
+		}
+
+		var up, active float64
+		if status.Err != nil {
+			log.Errorf("failed to check PuppetDB status: %s", status.Err)
+		} else if status.Status.Running() {
+			up = 1
+		}
+		if status.Active {
+			active = 1
+			if status.URL != e.activeURL {
+				log.Infof("querying PuppetDB %s %s", role, status.URL)
+				e.activeURL = status.URL
+			}
+		}
+
+		labels := e.appendMetric("pe_replica_status", up)
+		labels["url"] = status.URL
+		labels["role"] = role
+
+		labels = e.appendMetric("pe_replica_active", active)
+		labels["url"] = status.URL
+		labels["role"] = role
+	}
+}
+
+// NodeStatus returns the status of a node along with the time of its latest
+// report and, for unreported nodes, the reason why it is considered unreported.
+func NodeStatus(node puppetdb.Node, unreportedDuration time.Duration) (status, reason string, latestReport time.Time) {
+	if node.Deactivated != "" {
+		return StatusDeactivated, "", latestReport
+	}
+
+	// Nodes expired by PuppetDB's node-ttl are inactive rather than
+	// unreported, even though they stopped reporting
+	if node.Expired != "" {
+		return StatusExpired, "", latestReport
+	}
+
+	// Note: The unreported nodes in puppetboard (front end) will filter out nodes in
+	// the puppetdb if they have gone unreported for a long time (~1 week+). These nodes
+	// are queryable via the API and will not have a "lastestReport" on them.
+	// These nodes are NOT listed in puppetboard under "unreported" nodes either.
+	if node.ReportTimestamp == "" {
+		return StatusUnreported, "Timestamp string is blank", latestReport
+	}
+
+	latestReport, err := ParseTimestamp(node.ReportTimestamp)
+	if err != nil {
+		return StatusUnreported, "Invalid time parsed", latestReport
+	}
+
+	if latestReport.Add(unreportedDuration).Before(time.Now()) {
+		return StatusUnreported, fmt.Sprintf("Latest timestamp older than %s", unreportedDuration), latestReport
+	}
+
+	if node.LatestReportStatus == "" {
+		return StatusUnreported, "Unreported status", latestReport
+	}
+
+	return node.LatestReportStatus, "", latestReport
+}
+
+// included reports whether the node passes the certname filters and belongs
+// to the shard of the exporter
+func (e *Exporter) included(certname string) bool {
+	if e.options.CertnameInclude != nil && !e.options.CertnameInclude.MatchString(certname) {
+		return false
+	}
+	if e.options.CertnameExclude != nil && e.options.CertnameExclude.MatchString(certname) {
+		return false
+	}
+	if e.options.ShardTotal > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(certname))
+		if int(h.Sum32()%uint32(e.options.ShardTotal)) != e.options.ShardIndex {
+			return false
+		}
+	}
+	return true
+}
+
+// problemStatus reports whether a node with the given status needs attention
+func problemStatus(status string) bool {
+	return status == "failed" || status == "changed" || status == StatusUnreported
+}
+
+// appendNodeStatus records the status of a node as a value of 1 for its
+// status, and 0 for the other ones of nodeStatuses
+func (e *Exporter) appendNodeStatus(host, status string) {
+	for _, s := range nodeStatuses {
+		var value float64
+		if s == status {
+			value = 1
+		}
+		labels := e.appendMetric("node_status", value)
+		labels["host"] = host
+		labels["status"] = s
+	}
+	if !slices.Contains(nodeStatuses, status) {
+		labels := e.appendMetric("node_status", 1)
+		labels["host"] = host
+		labels["status"] = status
+	}
+}
+
+// appendMetric records a metric for the named gauge in the current cycle and
+// returns its labels map for the caller to fill. The map allocated at the same
+// position in a previous cycle is reused when available.
+func (e *Exporter) appendMetric(name string, value float64) prometheus.Labels {
+	ms := e.reports[name]
+	if n := len(ms); n < cap(ms) {
+		ms = ms[:n+1]
+		ms[n].value = value
+		if ms[n].labels == nil {
+			ms[n].labels = prometheus.Labels{}
+		}
+	} else {
+		ms = append(ms, metric{labels: prometheus.Labels{}, value: value})
+	}
+	e.reports[name] = ms
+
+	return ms[len(ms)-1].labels
+}
+
+// reportMetricName returns the name label of a report metric, formatted
+// unless RawReportMetricNames is set
+func (e *Exporter) reportMetricName(name string) string {
+	if e.options.RawReportMetricNames {
+		return e.labels.intern(name)
+	}
+	return e.names.transform(name, formatMetricName)
+}
+
+// formatMetricName turns a report metric name such as "config_retrieval" into
+// its display form "Config Retrieval"
+func formatMetricName(name string) string {
+	return strings.ReplaceAll(strings.Title(name), "_", " ")
+}
+
+// initGauges creates and registers the metrics of the enabled features, none
+// being registered when the labels of a gauge are invalid
+func (e *Exporter) initGauges() error {
+	e.metrics = map[string]*prometheus.GaugeVec{}
+	e.fqNames = map[string]string{}
+	e.labelSources = map[string][]string{}
+
+	e.newGauge(e.namespace, "node_report_status_count", "Total count of reports status by type", []string{"status"})
+	e.newGauge(e.namespace, "node_report_status_by_environment_count", "Total count of reports status by environment and type", []string{"environment", "status"})
+
+	for _, fact := range e.options.FactMetrics {
+		e.newGauge(e.nodeNamespace, factMetricName(fact), fmt.Sprintf("Value of the %s fact", fact),
+			append([]string{"host", "environment"}, e.factLabels...))
+	}
+
+	if e.options.AgentVersions {
+		e.newGauge(e.namespace, "nodes_by_agent_version", "Total count of nodes by Puppet agent version", []string{"version"})
+	}
+	if e.options.Producers {
+		e.newGauge(e.namespace, "nodes_by_producer", "Total count of nodes by Puppet Server which compiled their latest catalog and report status", []string{"producer", "status"})
+	}
+	if e.options.OSVersions {
+		e.newGauge(e.namespace, "nodes_by_os", "Total count of nodes by operating system family and major release", []string{"family", "release"})
+	}
+
+	if len(e.options.CatalogResources) > 0 {
+		e.newGauge(e.namespace, "nodes_with_resource", "Total count of active nodes whose catalog holds a resource by type and title", []string{"type", "title"})
+	}
+
+	e.newGauge(e.namespace, "server_info", "Version of the PuppetDB server queries are sent to", []string{"version"})
+	if e.options.Status {
+		e.initStatusGauges()
+	}
+	if e.options.Commands {
+		e.initCommandGauges()
+	}
+	if e.options.Population {
+		e.initPopulationGauges()
+	}
+	if e.options.CodeManager != nil {
+		e.initCodeManagerGauges()
+	}
+	if e.options.Patching {
+		e.initPatchingGauges()
+	}
+	if e.options.Packages {
+		e.initPackageGauges()
+	}
+	if e.options.PuppetServer != nil {
+		e.initPuppetServerGauges()
+		if e.options.CA {
+			e.initCAGauges()
+		}
+	}
+
+	if e.failover {
+		e.newGauge(e.namespace, "pe_replica_status", "Whether the PuppetDB service of a PE primary or replica is running",
+			[]string{"url", "role"})
+		e.newGauge(e.namespace, "pe_replica_active", "Whether a PE primary or replica is the PuppetDB being queried",
+			[]string{"url", "role"})
+	}
+
+	e.newGauge(e.nodeNamespace, "report", "Timestamp of latest report",
+		append([]string{"environment", "host", "deactivated", "status"}, e.factLabels...))
+
+	e.newGauge(e.nodeNamespace, "report_unreported_info", "Reason why a node is considered unreported", []string{"host", "reason"})
+
+	// The run durations are exported whatever the enabled categories
+	e.newGauge(e.nodeNamespace, "report_time_total", "Duration of latest Puppet run in seconds",
+		append([]string{"environment", "host"}, e.factLabels...))
+	e.newGauge(e.nodeNamespace, "report_time_config_retrieval", "Duration of the catalog retrieval of latest Puppet run in seconds",
+		append([]string{"environment", "host"}, e.factLabels...))
+
+	if e.options.Resources {
+		e.newGauge(e.nodeNamespace, "report_resources", "Count of resources of latest report by state",
+			append([]string{"environment", "host", "state"}, e.factLabels...))
+	}
+
+	if e.options.Events {
+		e.newGauge(e.nodeNamespace, "report_event_counts", "Count of events of latest report by result",
+			append([]string{"environment", "host", "result"}, e.factLabels...))
+	}
+
+	if e.options.FailedResources {
+		e.newGauge(e.nodeNamespace, "failed_resource", "Resource which failed in latest report",
+			[]string{"environment", "host", "resource_type", "resource_title"})
+		e.newGauge(e.namespace, "failed_resources_dropped", "Count of failed resources not exported because of the series limit", nil)
+	}
+
+	if e.options.FlappingReports > 0 {
+		e.newGauge(e.nodeNamespace, "report_flapping", "Whether enough of the latest runs changed or failed for the node to be flapping",
+			append([]string{"environment", "host"}, e.factLabels...))
+		e.newGauge(e.namespace, "nodes_flapping_count", "Total count of flapping nodes", nil)
+	}
+
+	if e.options.Logs {
+		e.newGauge(e.nodeNamespace, "report_logs", "Count of log entries of latest report by level",
+			append([]string{"environment", "host", "level"}, e.factLabels...))
+	}
+
+	if e.options.Changes {
+		e.newGauge(e.nodeNamespace, "report_corrective_changes", "Count of corrective changes of latest report",
+			append([]string{"environment", "host"}, e.factLabels...))
+		e.newGauge(e.nodeNamespace, "report_intentional_changes", "Count of intentional changes of latest report",
+			append([]string{"environment", "host"}, e.factLabels...))
+		e.newGauge(e.nodeNamespace, "corrective_changes_by_environment", "Sum of the corrective changes of the latest reports by environment", []string{"environment"})
+		e.newGauge(e.nodeNamespace, "intentional_changes_by_environment", "Sum of the intentional changes of the latest reports by environment", []string{"environment"})
+	}
+
+	if e.options.NodeInfo {
+		e.newGauge(e.nodeNamespace, "node_info", "Environment, Puppet agent version and operating system of the node", []string{"host", "environment", "agent_version", "os", "deactivated"})
+	}
+	if e.options.NodeStatus {
+		e.newGauge(e.nodeNamespace, "node_status", "Whether the status of the node is the one of the status label", []string{"host", "status"})
+	}
+
+	if e.options.RunDurationQuantiles {
+		e.newGauge(e.nodeNamespace, "run_duration_seconds", "Quantiles of the total duration of the latest runs by environment", []string{"environment", "quantile"})
+	}
+
+	if e.options.ResourceTotals {
+		var labelNames []string
+		if e.options.ResourceTotalsByEnvironment {
+			labelNames = []string{"environment"}
+		}
+		for _, state := range resourceStates {
+			e.newGauge(e.nodeNamespace, resourceTotalName(state), fmt.Sprintf("Sum of the %s resources of the latest reports", state), labelNames)
+		}
+	}
+
+	e.newGauge(e.nodeNamespace, "facts_timestamp", "Timestamp of latest facts upload",
+		append([]string{"environment", "host"}, e.factLabels...))
+
+	e.newGauge(e.nodeNamespace, "catalog_timestamp", "Timestamp of latest catalog compilation",
+		append([]string{"environment", "host"}, e.factLabels...))
+
+	e.newGauge(e.nodeNamespace, "report_noop", "Whether latest report ran in noop mode",
+		append([]string{"environment", "host"}, e.factLabels...))
+
+	e.newGauge(e.namespace, "nodes_noop_count", "Total count of nodes whose latest report ran in noop mode", nil)
+	e.newGauge(e.namespace, "nodes_deactivated_count", "Total count of deactivated nodes", nil)
+	e.newGauge(e.namespace, "nodes_expired_count", "Total count of nodes expired by node-ttl", nil)
+
+	e.newGauge(e.namespace, "nodes_cached_catalog_count", "Total count of nodes whose latest run used a cached catalog by reason", []string{"reason"})
+
+	e.newGauge(e.namespace, "stale_catalog_count", "Total count of active nodes whose latest catalog is older than the unreported duration", nil)
+
+	e.initQueryGauges()
+	if e.gaugeErr != nil {
+		return e.gaugeErr
+	}
+	if err := e.initCategoryGauges(); err != nil {
+		return err
+	}
+
+	for name, m := range e.metrics {
+		if name == "report" && e.options.ReportTimestamps {
+			e.registry.MustRegister(timestampedGauge{m})
+			continue
+		}
+		e.registry.MustRegister(m)
+	}
+
+	e.stageDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of the stages of the latest scrape cycle",
+	}, []string{"stage"})
+	e.registry.MustRegister(e.stageDuration)
+
+	e.effectiveInterval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "effective_interval_seconds",
+		Help:      "Interval between two scrape cycles, including automatic adjustments",
+	})
+	e.registry.MustRegister(e.effectiveInterval)
+
+	e.restoredTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "restored_state_timestamp_seconds",
+		Help:      "Time the metrics restored from the state file were collected, 0 once a scrape cycle replaced them",
+	})
+	e.registry.MustRegister(e.restoredTime)
+
+	e.scrapeTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_timeouts_total",
+		Help:      "Total number of scrape cycles aborted by the scrape timeout",
+	})
+	e.registry.MustRegister(e.scrapeTimeouts)
+
+	// Compared with the time of the Prometheus server, it reveals clock skews
+	// which would make nodes unreported
+	e.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "time_seconds",
+		Help:      "Current time of the exporter host",
+	}, func() float64 {
+		return float64(time.Now().UnixNano()) / 1e9
+	}))
+
+	e.registry.MustRegister(&clientCollector{
+		client: e.client,
+		lastSuccess: prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "client", "last_success_timestamp_seconds"),
+			"Time of the latest successful query of the PuppetDB API by endpoint", []string{"endpoint"}, nil),
+		cacheHits: prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "client", "cache_hits_total"),
+			"Responses of the PuppetDB API reused after a conditional request answered 304 Not Modified, by endpoint", []string{"endpoint"}, nil),
+	})
+
+	e.seriesLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Subsystem: "exporter",
+		Name:      "series_limit_exceeded",
+		Help:      "Whether the series limits are exceeded and the per-host metrics dropped",
+	})
+	e.registry.MustRegister(e.seriesLimit)
+
+	if e.options.Lock != nil {
+		e.leader = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: e.namespace,
+			Subsystem: "exporter",
+			Name:      "leader",
+			Help:      "Whether this instance is the elected one scraping PuppetDB",
+		})
+		e.registry.MustRegister(e.leader)
+	}
+
+	e.reportAge = newSnapshotBuckets(prometheus.BuildFQName(e.namespace, "", "report_age_nodes"),
+		"Count of active nodes whose latest report is at most le seconds old, as of the latest scrape cycle", e.options.ReportAgeBuckets)
+	e.registry.MustRegister(e.reportAge)
+
+	if len(e.options.JMXMBeans) > 0 {
+		e.jmx = &jmxCollector{}
+		e.registry.MustRegister(e.jmx)
+	}
+	return nil
+}
+
+// newGauge creates the gauge published from the reports of the same name. An
+// invalid relabeling of its labels is kept in gaugeErr, as gauges are created
+// in bulk.
+func (e *Exporter) newGauge(namespace, name, help string, labelNames []string) {
+	if err := e.addGauge(namespace, name, help, labelNames); err != nil && e.gaugeErr == nil {
+		e.gaugeErr = err
+	}
+}
+
+// addGauge creates the gauge published from the reports of the same name
+func (e *Exporter) addGauge(namespace, name, help string, labelNames []string) error {
+	fqName := prometheus.BuildFQName(namespace, "", name)
+	labelNames, sources, err := e.relabel(fqName, labelNames)
+	if err != nil {
+		return err
+	}
+	e.fqNames[name] = fqName
+	if sources == nil {
+		sources = labelNames
+	}
+	e.labelSources[name] = sources
+
+	e.metrics[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, labelNames)
+	return nil
+}
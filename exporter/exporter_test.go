@@ -0,0 +1,158 @@
+package exporter_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/exporter"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb/puppetdbtest"
+)
+
+// newServer starts a fake PuppetDB serving two nodes and the time metrics of
+// their reports
+func newServer() *puppetdbtest.Server {
+	now := time.Now().UTC()
+	srv := puppetdbtest.NewServer(
+		puppetdb.Node{
+			Certname:           "web1.example.com",
+			LatestReportStatus: "changed",
+			ReportEnvironment:  "production",
+			ReportTimestamp:    now.Add(-10 * time.Minute).Format(time.RFC3339),
+			LatestReportHash:   "aaa",
+		},
+		puppetdb.Node{
+			Certname:           "db1.example.com",
+			LatestReportStatus: "failed",
+			ReportEnvironment:  "production",
+			ReportTimestamp:    now.Add(-20 * time.Minute).Format(time.RFC3339),
+			LatestReportHash:   "bbb",
+		},
+	)
+	srv.ReportMetrics["aaa"] = []puppetdb.ReportMetric{{Category: "time", Name: "total", Value: 12.5}}
+	srv.ReportMetrics["bbb"] = []puppetdb.ReportMetric{{Category: "time", Name: "total", Value: 3}}
+	return srv
+}
+
+func TestExporterOnce(t *testing.T) {
+	srv := newServer()
+	defer srv.Close()
+
+	registry := prometheus.NewRegistry()
+	exp, err := exporter.NewPuppetDBExporter(srv.Options(), &exporter.Options{
+		Categories: map[string]struct{}{"time": {}},
+		Registerer: registry,
+	})
+	if err != nil {
+		t.Fatalf("failed to create exporter: %s", err)
+	}
+	if err := exp.Once("2h", false); err != nil {
+		t.Fatalf("failed to scrape: %s", err)
+	}
+
+	expected := `
+# HELP puppet_report_time Total count of time per status
+# TYPE puppet_report_time gauge
+puppet_report_time{deactivated="false",environment="production",host="db1.example.com",name="Total",status="failed"} 3
+puppet_report_time{deactivated="false",environment="production",host="web1.example.com",name="Total",status="changed"} 12.5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "puppet_report_time"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExporterIncrementalDropsRemovedNodes(t *testing.T) {
+	srv := newServer()
+	defer srv.Close()
+
+	registry := prometheus.NewRegistry()
+	exp, err := exporter.NewPuppetDBExporter(srv.Options(), &exporter.Options{
+		Categories:          map[string]struct{}{"time": {}},
+		FullRefreshInterval: time.Hour,
+		Registerer:          registry,
+	})
+	if err != nil {
+		t.Fatalf("failed to create exporter: %s", err)
+	}
+	if err := exp.Once("2h", false); err != nil {
+		t.Fatalf("failed to scrape: %s", err)
+	}
+
+	// The node is purged, so that neither the changed nodes nor the
+	// certnames list it
+	srv.Mu.Lock()
+	srv.Nodes = srv.Nodes[:1]
+	srv.Mu.Unlock()
+	if err := exp.Once("2h", false); err != nil {
+		t.Fatalf("failed to scrape: %s", err)
+	}
+
+	expected := `
+# HELP puppet_report_time Total count of time per status
+# TYPE puppet_report_time gauge
+puppet_report_time{deactivated="false",environment="production",host="web1.example.com",name="Total",status="changed"} 12.5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "puppet_report_time"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExporterFactsFailure(t *testing.T) {
+	srv := newServer()
+	defer srv.Close()
+	srv.Facts = []puppetdb.Fact{{Certname: "db1.example.com", Name: "maintenance", Value: true}}
+
+	registry := prometheus.NewRegistry()
+	exp, err := exporter.NewPuppetDBExporter(srv.Options(), &exporter.Options{
+		SilenceFact: "maintenance",
+		Registerer:  registry,
+	})
+	if err != nil {
+		t.Fatalf("failed to create exporter: %s", err)
+	}
+	if err := exp.Once("2h", false); err != nil {
+		t.Fatalf("failed to scrape: %s", err)
+	}
+
+	// The node stays silenced with the facts of the previous cycle
+	srv.Mu.Lock()
+	srv.Fail = func(r *http.Request) bool { return strings.HasSuffix(r.URL.Path, "/facts") }
+	srv.Mu.Unlock()
+	if err := exp.Once("2h", false); err != nil {
+		t.Fatalf("failed to scrape: %s", err)
+	}
+
+	expected := `
+# HELP puppetdb_node_report_status_count Total count of reports status by type
+# TYPE puppetdb_node_report_status_count gauge
+puppetdb_node_report_status_count{status="changed"} 1
+puppetdb_node_report_status_count{status="silenced"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "puppetdb_node_report_status_count"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExporterFactsFailureFirstCycle(t *testing.T) {
+	srv := newServer()
+	defer srv.Close()
+	srv.Fail = func(r *http.Request) bool { return strings.HasSuffix(r.URL.Path, "/facts") }
+
+	exp, err := exporter.NewPuppetDBExporter(srv.Options(), &exporter.Options{
+		SilenceFact: "maintenance",
+		Registerer:  prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create exporter: %s", err)
+	}
+	// Without previous facts, the cycle is aborted rather than unsilencing
+	// the nodes
+	if err := exp.Once("2h", false); err == nil {
+		t.Error("expected the scrape cycle to be aborted")
+	}
+}
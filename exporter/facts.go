@@ -0,0 +1,263 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+var invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// nodeFacts maps certnames to the values of their facts by fact name
+type nodeFacts map[string]map[string]interface{}
+
+// factNames returns the names of the facts used by the enabled features
+func (e *Exporter) factNames() (names []string) {
+	if e.options.SilenceFact != "" {
+		names = append(names, e.options.SilenceFact)
+	}
+	if e.options.ThresholdFact != "" {
+		names = append(names, e.options.ThresholdFact)
+	}
+	for _, o := range e.options.ThresholdOverrides {
+		names = append(names, o.Fact)
+	}
+	if e.options.AgentVersions || e.options.NodeInfo {
+		names = append(names, factAgentVersion, factPuppetVersion)
+	}
+	if e.options.OSVersions || e.options.NodeInfo {
+		names = append(names, factOSFamily, factOSRelease)
+	}
+	if e.options.Patching {
+		names = append(names, patchingFactNames()...)
+	}
+	if e.options.SD {
+		names = append(names, e.options.SDFacts...)
+	}
+	if e.options.SDFile != "" {
+		for fact := range e.options.SDFileLabels {
+			names = append(names, fact)
+		}
+	}
+	names = append(names, e.options.FactMetrics...)
+	names = append(names, e.options.FactLabels...)
+	return
+}
+
+// factLabelNames returns the names of the labels holding the facts in
+// FactLabels, and an error if one of them conflicts with the given labels
+func factLabelNames(facts []string, reserved []string) ([]string, error) {
+	names := make([]string, 0, len(facts))
+	for _, fact := range facts {
+		name := invalidNameChars.ReplaceAllString(fact, "_")
+		if slices.Contains(reserved, name) || slices.Contains(names, name) {
+			return nil, fmt.Errorf("label %s of fact %s is already used", name, fact)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// nodeGroupsKey is the key of the PE node groups of a node in its facts. The
+// parentheses keep it apart from actual fact names.
+const nodeGroupsKey = "(node_groups)"
+
+// setFactLabels sets the labels holding the facts in FactLabels, and the
+// node_groups label when the classifier is configured
+func (e *Exporter) setFactLabels(labels map[string]string, facts map[string]interface{}) {
+	for i, fact := range e.options.FactLabels {
+		labels[e.factLabels[i]] = e.labels.intern(factString(facts[fact]))
+	}
+	if e.options.Classifier != nil {
+		labels["node_groups"], _ = facts[nodeGroupsKey].(string)
+	}
+}
+
+// factString converts a fact value to a label value, structured facts are
+// rendered as JSON
+func factString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
+
+// factMetricName returns the key of the gauge exporting the fact
+func factMetricName(fact string) string {
+	return "fact_" + invalidNameChars.ReplaceAllString(fact, "_")
+}
+
+// factValue converts a fact value to a sample value
+func factValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// appendFactMetrics records the numeric facts of a node
+func (e *Exporter) appendFactMetrics(facts map[string]interface{}, host, environment string) {
+	for _, fact := range e.options.FactMetrics {
+		value, ok := factValue(facts[fact])
+		if !ok {
+			continue
+		}
+
+		labels := e.appendMetric(factMetricName(fact), value)
+		labels["host"] = host
+		labels["environment"] = environment
+		e.setFactLabels(labels, facts)
+	}
+}
+
+// fetchFacts retrieves the facts used by the enabled features. Dotted names
+// such as os.release.major are paths into structured facts, which are looked
+// up through the fact-contents endpoint and stored under their dotted name.
+func (e *Exporter) fetchFacts(ctx context.Context) (nodeFacts, error) {
+	var names []string
+	var paths [][]string
+	for _, name := range e.factNames() {
+		if strings.Contains(name, ".") {
+			path := strings.Split(name, ".")
+			if !slices.ContainsFunc(paths, func(p []string) bool { return slices.Equal(p, path) }) {
+				paths = append(paths, path)
+			}
+		} else if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	decoded := e.client.Decoded()[puppetdb.QueryFacts]
+	var facts []puppetdb.Fact
+	var contents []puppetdb.FactContent
+	var err error
+	if len(names) > 0 {
+		if facts, err = e.client.Facts(ctx, names); err != nil {
+			return nil, err
+		}
+	}
+	if len(paths) > 0 {
+		if contents, err = e.client.FactContents(ctx, paths); err != nil {
+			return nil, err
+		}
+	}
+
+	// No response was decoded when they were all revalidated, so the
+	// facts are those of the previous cycle
+	if e.options.ConditionalRequests && e.lastFacts != nil && e.client.Decoded()[puppetdb.QueryFacts] == decoded {
+		return e.lastFacts, nil
+	}
+
+	nf := nodeFacts{}
+	set := func(certname, name string, value interface{}) {
+		if nf[certname] == nil {
+			nf[certname] = map[string]interface{}{}
+		}
+		nf[certname][name] = value
+	}
+	for _, fact := range facts {
+		set(fact.Certname, fact.Name, fact.Value)
+	}
+	for _, content := range contents {
+		set(content.Certname, e.labels.intern(factPath(content.Path)), content.Value)
+	}
+
+	e.lastFacts = nf
+	return nf, nil
+}
+
+// factPath joins the elements of a fact-contents path with dots
+func factPath(path []interface{}) string {
+	elements := make([]string, len(path))
+	for i, element := range path {
+		elements[i] = fmt.Sprint(element)
+	}
+	return strings.Join(elements, ".")
+}
+
+// silenced reports whether the node opted out of alert-relevant metrics
+func (e *Exporter) silenced(facts map[string]interface{}) bool {
+	if e.options.SilenceFact == "" {
+		return false
+	}
+
+	switch v := facts[e.options.SilenceFact].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// ThresholdOverride is the unreported duration of the nodes whose fact has
+// the given value
+type ThresholdOverride struct {
+	Fact     string
+	Value    string
+	Duration time.Duration
+}
+
+// ParseThresholdOverride parses an override given as fact=value:duration,
+// e.g. trusted.extensions.pp_role=laptop:7d
+func ParseThresholdOverride(s string) (ThresholdOverride, error) {
+	i := strings.LastIndex(s, ":")
+	j := strings.Index(s, "=")
+	if i < 0 || j <= 0 || j > i {
+		return ThresholdOverride{}, fmt.Errorf("invalid unreported threshold override %q, expected fact=value:duration", s)
+	}
+
+	d, err := model.ParseDuration(s[i+1:])
+	if err != nil {
+		return ThresholdOverride{}, fmt.Errorf("invalid unreported threshold override %q: %s", s, err)
+	}
+	return ThresholdOverride{Fact: s[:j], Value: s[j+1 : i], Duration: time.Duration(d)}, nil
+}
+
+// unreportedThreshold returns the unreported duration of the node, which can
+// be overridden by its threshold fact, or else by the first override matching
+// its facts
+func (e *Exporter) unreportedThreshold(certname string, facts map[string]interface{}, unreportedDuration time.Duration) time.Duration {
+	value, ok := facts[e.options.ThresholdFact]
+	if e.options.ThresholdFact == "" || !ok {
+		for _, o := range e.options.ThresholdOverrides {
+			if v, ok := facts[o.Fact]; ok && fmt.Sprint(v) == o.Value {
+				return o.Duration
+			}
+		}
+		return unreportedDuration
+	}
+
+	d, err := model.ParseDuration(fmt.Sprint(value))
+	if err != nil {
+		log.Warnf("invalid unreported threshold of %s: %s", certname, err)
+		return unreportedDuration
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,39 @@
+package exporter
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// flapping reports whether at least FlappingThreshold of the latest
+// FlappingReports runs of the node changed or failed
+func (e *Exporter) flapping(ctx context.Context, certname string) (bool, error) {
+	reports, err := e.client.NodeReports(ctx, certname, e.options.FlappingReports)
+	if err != nil {
+		return false, err
+	}
+
+	runs := 0
+	for _, report := range reports {
+		if report.Status == "changed" || report.Status == "failed" {
+			runs++
+		}
+	}
+	log.Debugf("%s changed or failed in %d of its latest %d runs", certname, runs, len(reports))
+
+	return runs >= e.options.FlappingThreshold, nil
+}
+
+// appendFlapping records whether the node is flapping
+func (e *Exporter) appendFlapping(flapping bool, host, environment string, facts map[string]interface{}) {
+	var value float64
+	if flapping {
+		value = 1
+	}
+
+	labels := e.appendMetric("report_flapping", value)
+	labels["environment"] = environment
+	labels["host"] = host
+	e.setFactLabels(labels, facts)
+}
@@ -0,0 +1,30 @@
+package exporter
+
+import (
+	"net/http"
+)
+
+// ReadyHandler returns the handler serving /readyz, which succeeds once a
+// scrape cycle fetched the nodes and fails while the latest one could not
+func (e *Exporter) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !e.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Started returns a channel closed once the first scrape cycle succeeded
+func (e *Exporter) Started() <-chan struct{} {
+	return e.started
+}
+
+// setReady records the outcome of a scrape cycle
+func (e *Exporter) setReady(ok bool) {
+	e.ready.Store(ok)
+	if ok {
+		e.startOnce.Do(func() { close(e.started) })
+	}
+}
@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshotBuckets counts the nodes in cumulative buckets rebuilt from scratch
+// every scrape cycle, describing the distribution of a value across the nodes
+// rather than over time. The counts go down as well as up, so they are
+// exported as gauges labelled by upper bound, le="+Inf" counting every node,
+// rather than as a histogram whose buckets rate() expects to only grow.
+type snapshotBuckets struct {
+	desc    *prometheus.Desc
+	buckets []float64
+	// bounds are the le label values of the buckets, +Inf last
+	bounds []string
+
+	mu     sync.Mutex
+	counts []uint64
+}
+
+func newSnapshotBuckets(name, help string, buckets []float64) *snapshotBuckets {
+	bounds := make([]string, 0, len(buckets)+1)
+	for _, upper := range buckets {
+		bounds = append(bounds, strconv.FormatFloat(upper, 'g', -1, 64))
+	}
+	bounds = append(bounds, strconv.FormatFloat(math.Inf(1), 'g', -1, 64))
+
+	return &snapshotBuckets{
+		desc:    prometheus.NewDesc(name, help, []string{"le"}, nil),
+		buckets: buckets,
+		bounds:  bounds,
+		counts:  make([]uint64, len(bounds)),
+	}
+}
+
+// bucketsCycle accumulates the observations of a scrape cycle
+type bucketsCycle struct {
+	counts []uint64
+}
+
+func (h *snapshotBuckets) cycle() *bucketsCycle {
+	return &bucketsCycle{counts: make([]uint64, len(h.bounds))}
+}
+
+func (h *snapshotBuckets) observe(c *bucketsCycle, v float64) {
+	for i, upper := range h.buckets {
+		if v <= upper {
+			c.counts[i]++
+		}
+	}
+	c.counts[len(h.buckets)]++
+}
+
+// publish replaces the exported distribution with the one of the cycle
+func (h *snapshotBuckets) publish(c *bucketsCycle) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts = c.counts
+}
+
+// Describe implements prometheus.Collector
+func (h *snapshotBuckets) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+// Collect implements prometheus.Collector
+func (h *snapshotBuckets) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, count := range h.counts {
+		ch <- prometheus.MustNewConstMetric(h.desc, prometheus.GaugeValue, float64(count), h.bounds[i])
+	}
+}
@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// HostMapper turns certnames into the values of the host label
+type HostMapper struct {
+	// Lookup maps certnames to host names and takes precedence over the
+	// other rules
+	Lookup map[string]string
+	// Regex rewrites matching certnames into Replacement, which can refer to
+	// capture groups as $1 or ${name}
+	Regex       *regexp.Regexp
+	Replacement string
+	// StripDomain keeps the part of the certname before the first dot
+	StripDomain bool
+}
+
+// LoadHostLookup reads a lookup file made of "certname host" lines, blank
+// lines and lines starting with # are ignored
+func LoadHostLookup(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lookup := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a certname and a host", path, line)
+		}
+		lookup[fields[0]] = fields[1]
+	}
+	return lookup, scanner.Err()
+}
+
+// Host returns the host label value of the certname
+func (m *HostMapper) Host(certname string) string {
+	if host, ok := m.Lookup[certname]; ok {
+		return host
+	}
+
+	host := certname
+	if m.Regex != nil && m.Regex.MatchString(host) {
+		host = m.Regex.ReplaceAllString(host, m.Replacement)
+	}
+	if m.StripDomain {
+		host, _, _ = strings.Cut(host, ".")
+	}
+	return host
+}
+
+// host returns the host label value of the certname
+func (e *Exporter) host(certname string) string {
+	if e.options.HostMapper == nil {
+		return certname
+	}
+	return e.hosts.transform(certname, e.options.HostMapper.Host)
+}
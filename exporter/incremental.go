@@ -0,0 +1,124 @@
+package exporter
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// defaultIncrementalOverlap is the IncrementalOverlap used when unset
+const defaultIncrementalOverlap = 10 * time.Minute
+
+// nodeSnapshot is the node list merged across incremental scrape cycles, and
+// the metrics of the latest report of each node
+type nodeSnapshot struct {
+	nodes map[string]puppetdb.Node
+	// queried is the start of the latest nodes query, refreshed the one of
+	// the latest query of every node
+	queried   time.Time
+	refreshed time.Time
+	reports   map[string]cachedReport
+}
+
+// cachedReport holds the metrics of a report
+type cachedReport struct {
+	hash    string
+	metrics []puppetdb.ReportMetric
+}
+
+// fetchNodes returns every node. With FullRefreshInterval, the whole list is
+// only fetched once per interval, in between the nodes which changed since
+// the previous cycle are merged into the list of the previous cycle. With
+// ConditionalRequests alone, the whole list is fetched every cycle, the
+// snapshot only keeping the report metrics.
+func (e *Exporter) fetchNodes(ctx context.Context) ([]puppetdb.Node, error) {
+	if e.options.FullRefreshInterval <= 0 && !e.options.ConditionalRequests {
+		return e.client.Nodes(ctx)
+	}
+
+	start := time.Now()
+	s := e.snapshot
+	if s == nil || start.Sub(s.refreshed) >= e.options.FullRefreshInterval {
+		nodes, err := e.client.Nodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		s = &nodeSnapshot{
+			nodes:     make(map[string]puppetdb.Node, len(nodes)),
+			queried:   start,
+			refreshed: start,
+			reports:   make(map[string]cachedReport, len(nodes)),
+		}
+		for _, node := range nodes {
+			s.nodes[node.Certname] = node
+			if e.snapshot != nil {
+				if report, ok := e.snapshot.reports[node.Certname]; ok {
+					s.reports[node.Certname] = report
+				}
+			}
+		}
+		e.snapshot = s
+		return nodes, nil
+	}
+
+	overlap := e.options.IncrementalOverlap
+	if overlap <= 0 {
+		overlap = defaultIncrementalOverlap
+	}
+	changed, err := e.client.NodesSince(ctx, s.queried.Add(-overlap))
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range changed {
+		s.nodes[node.Certname] = node
+	}
+
+	// The changed nodes only include those still matching the filters, the
+	// ones deactivated with ActiveOnly, moved out of the environments or
+	// purged are dropped as their certnames are no longer listed
+	certnames, err := e.client.Certnames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]struct{}, len(certnames))
+	for _, certname := range certnames {
+		listed[certname] = struct{}{}
+	}
+	for certname := range s.nodes {
+		if _, ok := listed[certname]; !ok {
+			delete(s.nodes, certname)
+			delete(s.reports, certname)
+		}
+	}
+	s.queried = start
+
+	nodes := make([]puppetdb.Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Certname < nodes[j].Certname })
+	return nodes, nil
+}
+
+// reportMetrics returns the metrics of the latest report of a node, which
+// are only fetched when the report changed with FullRefreshInterval or
+// ConditionalRequests
+func (e *Exporter) reportMetrics(ctx context.Context, node puppetdb.Node) ([]puppetdb.ReportMetric, error) {
+	if e.snapshot == nil {
+		return e.client.ReportMetrics(ctx, node.LatestReportHash)
+	}
+
+	if report, ok := e.snapshot.reports[node.Certname]; ok && report.hash == node.LatestReportHash {
+		return report.metrics, nil
+	}
+
+	metrics, err := e.client.ReportMetrics(ctx, node.LatestReportHash)
+	if err != nil {
+		return nil, err
+	}
+	e.snapshot.reports[node.Certname] = cachedReport{hash: node.LatestReportHash, metrics: metrics}
+	return metrics, nil
+}
@@ -0,0 +1,42 @@
+package exporter
+
+// interner deduplicates repeated strings such as environments, statuses and
+// reasons so that each scrape cycle shares the same backing strings instead of
+// retaining the copies decoded from every PuppetDB response. The table is
+// bounded: once it holds max entries it is dropped and rebuilt from scratch.
+type interner struct {
+	max     int
+	strings map[string]string
+}
+
+func newInterner(max int) *interner {
+	return &interner{
+		max:     max,
+		strings: make(map[string]string),
+	}
+}
+
+// intern returns the canonical copy of s
+func (i *interner) intern(s string) string {
+	return i.transform(s, nil)
+}
+
+// transform returns the cached result of f(s), computing and storing it on the
+// first lookup. A nil f caches s itself.
+func (i *interner) transform(s string, f func(string) string) string {
+	if v, ok := i.strings[s]; ok {
+		return v
+	}
+
+	if len(i.strings) >= i.max {
+		clear(i.strings)
+	}
+
+	v := s
+	if f != nil {
+		v = f(s)
+	}
+	i.strings[s] = v
+
+	return v
+}
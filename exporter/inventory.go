@@ -0,0 +1,83 @@
+package exporter
+
+import "context"
+
+// Facts holding the Puppet agent version, the AIO package version is
+// preferred as it also identifies the bundled Facter and Ruby
+const (
+	factAgentVersion  = "aio_agent_version"
+	factPuppetVersion = "puppetversion"
+)
+
+// Structured fact paths identifying the operating system of a node
+const (
+	factOSFamily  = "os.family"
+	factOSRelease = "os.release.major"
+)
+
+// unknownValue is the label value of nodes missing the counted fact
+const unknownValue = "unknown"
+
+// agentVersion returns the Puppet agent version of a node
+func agentVersion(facts map[string]interface{}) string {
+	for _, fact := range []string{factAgentVersion, factPuppetVersion} {
+		if v := factString(facts[fact]); v != "" {
+			return v
+		}
+	}
+	return unknownValue
+}
+
+// appendNodeInfo records the identity of a node, which changes too seldom
+// to be worth new series of the value bearing metrics
+func (e *Exporter) appendNodeInfo(host, environment, deactivated string, facts map[string]interface{}) {
+	os := osVersion(facts)
+	labels := e.appendMetric("node_info", 1)
+	labels["host"] = host
+	labels["environment"] = environment
+	labels["agent_version"] = e.labels.intern(agentVersion(facts))
+	labels["os"] = e.labels.intern(os.family + " " + os.release)
+	labels["deactivated"] = deactivated
+}
+
+// producerStatus identifies the nodes compiled by the same Puppet Server with
+// the same status
+type producerStatus struct {
+	producer string
+	status   string
+}
+
+// fetchProducers retrieves the producers of the latest reports by certname
+func (e *Exporter) fetchProducers(ctx context.Context) (map[string]string, error) {
+	reports, err := e.client.LatestReportProducers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	producers := make(map[string]string, len(reports))
+	for _, report := range reports {
+		producers[report.Certname] = report.Producer
+	}
+	return producers, nil
+}
+
+// osKey identifies an operating system family and major release
+type osKey struct {
+	family  string
+	release string
+}
+
+// osVersion returns the operating system family and major release of a node
+func osVersion(facts map[string]interface{}) osKey {
+	key := osKey{
+		family:  factString(facts[factOSFamily]),
+		release: factString(facts[factOSRelease]),
+	}
+	if key.family == "" {
+		key.family = unknownValue
+	}
+	if key.release == "" {
+		key.release = unknownValue
+	}
+	return key
+}
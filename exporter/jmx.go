@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// jmxCollector exports the MBean attributes read during the latest scrape
+// cycle. Their names are only known once read, so it is an unchecked
+// collector which describes no metric.
+type jmxCollector struct {
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+}
+
+// Describe implements prometheus.Collector
+func (c *jmxCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector
+func (c *jmxCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+var camelCaseBoundary = regexp.MustCompile("([a-z0-9])([A-Z])")
+
+// jmxMetricName turns an MBean name such as
+// puppetlabs.puppetdb.mq:name=global.processing-time into the metric name
+// puppetdb_jmx_mq_global_processing_time
+func (e *Exporter) jmxMetricName(mbean string) string {
+	domain, properties, _ := strings.Cut(mbean, ":")
+	domain = strings.TrimPrefix(domain, "puppetlabs.puppetdb.")
+
+	// The name property identifies PuppetDB's metrics, the type property
+	// the JVM's ones
+	var name, typ []string
+	for _, property := range strings.Split(properties, ",") {
+		key, value, _ := strings.Cut(property, "=")
+		switch key {
+		case "name":
+			name = append(name, value)
+		case "type":
+			typ = append(typ, value)
+		}
+	}
+	parts := append([]string{e.namespace, "jmx", domain}, typ...)
+	parts = append(parts, name...)
+
+	return strings.ToLower(invalidNameChars.ReplaceAllString(strings.Join(parts, "_"), "_"))
+}
+
+// jmxAttributeName turns an attribute name such as OneMinuteRate into
+// one_minute_rate
+func jmxAttributeName(attribute string) string {
+	return strings.ToLower(camelCaseBoundary.ReplaceAllString(attribute, "${1}_${2}"))
+}
+
+// flattenAttributes collects the numeric attributes, composite attributes
+// such as HeapMemoryUsage are flattened into heap_memory_usage_used
+func flattenAttributes(prefix string, attributes map[string]interface{}, values map[string]float64) {
+	for attribute, value := range attributes {
+		name := jmxAttributeName(attribute)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch v := value.(type) {
+		case float64:
+			values[name] = v
+		case bool:
+			values[name] = boolValue(v)
+		case map[string]interface{}:
+			flattenAttributes(name, v, values)
+		}
+	}
+}
+
+// collectJMX reads the configured MBeans and replaces the exported metrics
+func (e *Exporter) collectJMX(ctx context.Context) {
+	var metrics []prometheus.Metric
+	seen := map[string]struct{}{}
+
+	for _, pattern := range e.options.JMXMBeans {
+		mbeans, err := e.client.MBeans(ctx, pattern)
+		if err != nil {
+			log.Errorf("failed to read MBeans: %s", err)
+			continue
+		}
+
+		names := make([]string, 0, len(mbeans))
+		for mbean := range mbeans {
+			names = append(names, mbean)
+		}
+		sort.Strings(names)
+
+		for _, mbean := range names {
+			name := e.jmxMetricName(mbean)
+			if _, ok := seen[name]; ok {
+				log.Debugf("MBean %s skipped, %s is already exported", mbean, name)
+				continue
+			}
+			seen[name] = struct{}{}
+
+			values := map[string]float64{}
+			flattenAttributes("", mbeans[mbean], values)
+
+			desc := prometheus.NewDesc(name, "Attribute of the MBean "+mbean, []string{"attribute"}, nil)
+			for attribute, value := range values {
+				metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, attribute))
+			}
+		}
+	}
+
+	e.jmx.mu.Lock()
+	e.jmx.metrics = metrics
+	e.jmx.mu.Unlock()
+}
@@ -0,0 +1,26 @@
+package exporter
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimestampLayouts are the layouts PuppetDB timestamps are parsed with, in
+// order. RFC 3339 accepts fractional seconds and offsets, further layouts
+// may be appended for PuppetDB versions or proxies rendering them otherwise.
+var TimestampLayouts = []string{time.RFC3339Nano}
+
+// TimestampLocation is the location of the timestamps parsed with a layout
+// without time zone
+var TimestampLocation = time.UTC
+
+// ParseTimestamp parses a PuppetDB timestamp with the first matching layout
+// of TimestampLayouts, and returns it in UTC
+func ParseTimestamp(value string) (time.Time, error) {
+	for _, layout := range TimestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, TimestampLocation); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("timestamp %q matches none of the layouts %q", value, TimestampLayouts)
+}
@@ -0,0 +1,46 @@
+package exporter
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// seriesLimitExceeded reports whether the series of the cycle exceed
+// MaxSeries in total, or MaxSeriesPerMetric for a per-host metric
+func (e *Exporter) seriesLimitExceeded() bool {
+	if e.options.MaxSeries <= 0 && e.options.MaxSeriesPerMetric <= 0 {
+		return false
+	}
+
+	total := 0
+	exceeded := false
+	for k, ms := range e.reports {
+		total += len(ms)
+		if e.options.MaxSeriesPerMetric > 0 && len(ms) > e.options.MaxSeriesPerMetric && perHost(ms) {
+			log.Debugf("%d series of %s over the limit of %d", len(ms), e.fqNames[k], e.options.MaxSeriesPerMetric)
+			exceeded = true
+		}
+	}
+	if e.options.MaxSeries > 0 && total > e.options.MaxSeries {
+		log.Debugf("%d series over the limit of %d", total, e.options.MaxSeries)
+		exceeded = true
+	}
+
+	if exceeded && !e.limitExceeded {
+		log.Warn("series limit exceeded, per-host metrics dropped")
+	} else if !exceeded && e.limitExceeded {
+		log.Info("series back under the limit, per-host metrics exported")
+	}
+	e.limitExceeded = exceeded
+	e.seriesLimit.Set(boolValue(exceeded))
+	return exceeded
+}
+
+// perHost reports whether the metrics are per-host detail rather than
+// aggregates
+func perHost(ms []metric) bool {
+	if len(ms) == 0 {
+		return false
+	}
+	_, ok := ms[0].labels["host"]
+	return ok
+}
@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// nodePackages holds the package inventory of a node
+type nodePackages struct {
+	count    int
+	packages []puppetdb.Package
+}
+
+// fetchPackages retrieves the number of packages of every node, and the
+// packages of PackageVersions, by certname
+func (e *Exporter) fetchPackages(ctx context.Context) (map[string]*nodePackages, error) {
+	inventory := map[string]*nodePackages{}
+	node := func(certname string) *nodePackages {
+		if inventory[certname] == nil {
+			inventory[certname] = &nodePackages{}
+		}
+		return inventory[certname]
+	}
+
+	counts, err := e.client.PackageCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		node(count.Certname).count = count.Count
+	}
+
+	if len(e.options.PackageVersions) > 0 {
+		packages, err := e.client.Packages(ctx, e.options.PackageVersions)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range packages {
+			n := node(p.Certname)
+			n.packages = append(n.packages, p)
+		}
+	}
+
+	return inventory, nil
+}
+
+// appendPackages records the package inventory of a node
+func (e *Exporter) appendPackages(inventory *nodePackages, host, environment string, facts map[string]interface{}) {
+	labels := e.appendMetric("packages_installed", float64(inventory.count))
+	labels["host"] = host
+	labels["environment"] = environment
+	e.setFactLabels(labels, facts)
+
+	for _, p := range inventory.packages {
+		labels := e.appendMetric("package_info", 1)
+		labels["host"] = host
+		labels["environment"] = environment
+		labels["package"] = e.labels.intern(p.PackageName)
+		labels["version"] = e.labels.intern(p.Version)
+		labels["provider"] = e.labels.intern(p.Provider)
+	}
+}
+
+func (e *Exporter) initPackageGauges() {
+	e.newGauge(e.nodeNamespace, "packages_installed", "Number of packages installed on the node",
+		append([]string{"host", "environment"}, e.factLabels...))
+	if len(e.options.PackageVersions) > 0 {
+		e.newGauge(e.nodeNamespace, "package_info", "Version of a package installed on the node",
+			[]string{"host", "environment", "package", "version", "provider"})
+	}
+}
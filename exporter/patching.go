@@ -0,0 +1,53 @@
+package exporter
+
+// patchingFacts are the structured facts of the pe_patch and os_patching
+// modules, in order of preference
+var patchingFacts = []string{"pe_patch", "os_patching"}
+
+// patchingGauges maps the paths into the patching facts to the gauges
+// exporting them
+var patchingGauges = []struct {
+	path string
+	name string
+	help string
+}{
+	{"package_update_count", "patch_package_updates", "Number of package updates available"},
+	{"security_package_update_count", "patch_security_updates", "Number of security package updates available"},
+	{"reboots.reboot_required", "patch_reboot_required", "Whether the node must be rebooted to complete patching"},
+}
+
+// patchingFactNames returns the fact paths read by the Patching option
+func patchingFactNames() (names []string) {
+	for _, fact := range patchingFacts {
+		for _, g := range patchingGauges {
+			names = append(names, fact+"."+g.path)
+		}
+	}
+	return
+}
+
+// appendPatching records the patching status of a node from the first
+// patching fact it has
+func (e *Exporter) appendPatching(facts map[string]interface{}, host, environment string) {
+	for _, g := range patchingGauges {
+		for _, fact := range patchingFacts {
+			value, ok := factValue(facts[fact+"."+g.path])
+			if !ok {
+				continue
+			}
+
+			labels := e.appendMetric(g.name, value)
+			labels["host"] = host
+			labels["environment"] = environment
+			e.setFactLabels(labels, facts)
+			break
+		}
+	}
+}
+
+func (e *Exporter) initPatchingGauges() {
+	for _, g := range patchingGauges {
+		e.newGauge(e.nodeNamespace, g.name, g.help+", from the pe_patch or os_patching fact",
+			append([]string{"host", "environment"}, e.factLabels...))
+	}
+}
@@ -0,0 +1,45 @@
+package exporter
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// populationMBeans matches the population MBeans of PuppetDB
+const populationMBeans = "puppetlabs.puppetdb.population:name=*"
+
+// populationGauges describes the gauges exporting the population MBeans
+var populationGauges = []struct {
+	mbean string
+	name  string
+	help  string
+}{
+	{"num-nodes", "population_nodes", "Number of nodes stored in PuppetDB"},
+	{"num-active-nodes", "population_active_nodes", "Number of active nodes stored in PuppetDB"},
+	{"num-inactive-nodes", "population_inactive_nodes", "Number of inactive nodes stored in PuppetDB"},
+	{"num-resources", "population_resources", "Number of resources in the catalogs stored in PuppetDB"},
+	{"avg-resources-per-node", "population_avg_resources_per_node", "Average number of resources per node"},
+	{"pct-resource-dupes", "population_pct_resource_dupes", "Percentage of resources shared by several catalogs"},
+}
+
+// checkPopulation records the population summary of PuppetDB
+func (e *Exporter) checkPopulation(ctx context.Context) {
+	mbeans, err := e.client.MBeans(ctx, populationMBeans)
+	if err != nil {
+		log.Errorf("failed to get population metrics: %s", err)
+		return
+	}
+
+	for _, g := range populationGauges {
+		if value, ok := mbeans["puppetlabs.puppetdb.population:name="+g.mbean]["Value"].(float64); ok {
+			e.appendMetric(g.name, value)
+		}
+	}
+}
+
+func (e *Exporter) initPopulationGauges() {
+	for _, g := range populationGauges {
+		e.newGauge(e.namespace, g.name, g.help, nil)
+	}
+}
@@ -0,0 +1,84 @@
+package exporter
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// publishReports sets the gauges to the metrics of the cycle, without the
+// per-host metrics when dropHosts is set
+func (e *Exporter) publishReports(dropHosts bool) {
+	for k, m := range e.metrics {
+		published := e.published[k]
+		if published == nil {
+			published = &seriesSet{}
+			e.published[k] = published
+		}
+
+		reports := e.reports[k]
+		if dropHosts && perHost(reports) {
+			reports = nil
+		}
+		published.publish(m, e.labelSources[k], reports)
+	}
+}
+
+// seriesSet tracks the series a gauge was published with, so that each cycle
+// updates the series reported again and deletes the other ones, instead of
+// resetting the gauge and creating every series anew. On large fleets, this
+// spares the gauge children and label pairs of every series each cycle.
+type seriesSet struct {
+	series map[string]*series
+	cycle  uint64
+	// key and values are reused from one series to the next
+	key    []byte
+	values []string
+}
+
+// series is a published series along with the latest cycle it was in
+type series struct {
+	values []string
+	cycle  uint64
+	// value is the sum of the metrics of the cycle with the label values
+	value float64
+}
+
+// publish sets the gauge to the reported metrics, whose label values are
+// taken from the labels named by sources, in label name order. The metrics
+// left with the same label values once labels are dropped are summed, e.g.
+// the counts by status and environment without the environment.
+func (s *seriesSet) publish(m *prometheus.GaugeVec, sources []string, reports []metric) {
+	if s.series == nil {
+		s.series = map[string]*series{}
+	}
+	s.cycle++
+
+	for _, t := range reports {
+		s.key, s.values = s.key[:0], s.values[:0]
+		for _, source := range sources {
+			value := t.labels[source]
+			s.values = append(s.values, value)
+			s.key = append(append(s.key, value...), 0xff)
+		}
+
+		entry, ok := s.series[string(s.key)]
+		if !ok {
+			entry = &series{values: slices.Clone(s.values)}
+			s.series[string(s.key)] = entry
+		}
+		if entry.cycle != s.cycle {
+			entry.cycle, entry.value = s.cycle, 0
+		}
+		entry.value += t.value
+	}
+
+	for key, entry := range s.series {
+		if entry.cycle != s.cycle {
+			m.DeleteLabelValues(entry.values...)
+			delete(s.series, key)
+			continue
+		}
+		m.WithLabelValues(entry.values...).Set(entry.value)
+	}
+}
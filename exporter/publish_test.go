@@ -0,0 +1,44 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSeriesSetPublishDroppedLabel(t *testing.T) {
+	m := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "count", Help: "Count"}, []string{"status"})
+	reports := []metric{
+		{labels: prometheus.Labels{"environment": "production", "status": "failed"}, value: 2},
+		{labels: prometheus.Labels{"environment": "staging", "status": "failed"}, value: 3},
+		{labels: prometheus.Labels{"environment": "staging", "status": "changed"}, value: 1},
+	}
+
+	var s seriesSet
+	// Publishing twice checks that the sums start over each cycle
+	for range 2 {
+		s.publish(m, []string{"status"}, reports)
+	}
+
+	expected := `
+# HELP count Count
+# TYPE count gauge
+count{status="changed"} 1
+count{status="failed"} 5
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	s.publish(m, []string{"status"}, reports[:1])
+	expected = `
+# HELP count Count
+# TYPE count gauge
+count{status="failed"} 2
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
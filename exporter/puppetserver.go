@@ -0,0 +1,118 @@
+package exporter
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkPuppetServer records the status of the Puppet Server services along
+// with the JRuby pool and request metrics
+func (e *Exporter) checkPuppetServer(ctx context.Context) {
+	services, err := e.options.PuppetServer.Services(ctx)
+	if err != nil {
+		log.Errorf("failed to check Puppet Server status: %s", err)
+		e.appendMetric("puppetserver_up", 0)
+		return
+	}
+	e.appendMetric("puppetserver_up", 1)
+
+	for name, service := range services {
+		labels := e.appendMetric("puppetserver_service_running", boolValue(service.State == "running"))
+		labels["service"] = e.labels.intern(name)
+	}
+
+	jruby, err := services.JRubyMetrics()
+	if err != nil {
+		log.Errorf("failed to get Puppet Server JRuby metrics: %s", err)
+	} else if jruby != nil {
+		labels := e.appendMetric("puppetserver_jruby_instances", float64(jruby.NumFreeJRubies))
+		labels["state"] = "free"
+		labels = e.appendMetric("puppetserver_jruby_instances", float64(jruby.NumJRubies-jruby.NumFreeJRubies))
+		labels["state"] = "used"
+
+		e.appendMetric("puppetserver_jruby_average_borrow_time_seconds", jruby.AverageBorrowTime/1000)
+		e.appendMetric("puppetserver_jruby_average_wait_time_seconds", jruby.AverageWaitTime/1000)
+		e.appendMetric("puppetserver_jruby_borrows", float64(jruby.BorrowCount))
+		e.appendMetric("puppetserver_jruby_borrow_timeouts", float64(jruby.BorrowTimeoutCount))
+		e.appendMetric("puppetserver_jruby_borrow_retries", float64(jruby.BorrowRetryCount))
+		e.appendMetric("puppetserver_jruby_queue_limit_hits", float64(jruby.QueueLimitHitCount))
+	}
+
+	requests, err := services.HTTPMetrics()
+	if err != nil {
+		log.Errorf("failed to get Puppet Server HTTP metrics: %s", err)
+	}
+	for _, request := range requests {
+		route := e.labels.intern(request.RouteID)
+
+		labels := e.appendMetric("puppetserver_http_requests", float64(request.Count))
+		labels["route"] = route
+		labels = e.appendMetric("puppetserver_http_request_mean_seconds", request.Mean/1000)
+		labels["route"] = route
+		labels = e.appendMetric("puppetserver_http_request_aggregate_seconds", request.Aggregate/1000)
+		labels["route"] = route
+	}
+}
+
+// certificateStates are the states of the certificates counted by checkCA
+var certificateStates = []string{"requested", "signed", "revoked"}
+
+// checkCA records the number of certificates of the Puppet CA by state, and
+// the expiry of the signed ones
+func (e *Exporter) checkCA(ctx context.Context) {
+	statuses, err := e.options.PuppetServer.CertificateStatuses(ctx)
+	if err != nil {
+		log.Errorf("failed to get Puppet CA certificates: %s", err)
+		return
+	}
+
+	counts := make(map[string]int, len(certificateStates))
+	for _, state := range certificateStates {
+		counts[state] = 0
+	}
+	for _, status := range statuses {
+		counts[status.State]++
+
+		if status.State != "signed" {
+			continue
+		}
+		notAfter, err := time.Parse(time.RFC3339, status.NotAfter)
+		if err != nil {
+			// The CA API renders dates as 2006-01-02T15:04:05UTC
+			notAfter, err = time.Parse("2006-01-02T15:04:05MST", status.NotAfter)
+		}
+		if err != nil {
+			log.Debugf("invalid expiry of certificate %s: %s", status.Name, err)
+			continue
+		}
+		labels := e.appendMetric("ca_certificate_expiry_timestamp", float64(notAfter.Unix()))
+		labels["name"] = status.Name
+	}
+
+	for state, count := range counts {
+		labels := e.appendMetric("ca_certificates", float64(count))
+		labels["state"] = e.labels.intern(state)
+	}
+}
+
+func (e *Exporter) initPuppetServerGauges() {
+	e.newGauge("", "puppetserver_up", "Whether the Puppet Server status API could be reached", nil)
+	e.newGauge("", "puppetserver_service_running", "Whether a Puppet Server service is running", []string{"service"})
+	e.newGauge("", "puppetserver_jruby_instances", "Number of JRuby instances by state", []string{"state"})
+	e.newGauge("", "puppetserver_jruby_average_borrow_time_seconds", "Average time JRuby instances are borrowed for", nil)
+	e.newGauge("", "puppetserver_jruby_average_wait_time_seconds", "Average time requests wait for a JRuby instance", nil)
+	e.newGauge("", "puppetserver_jruby_borrows", "Number of JRuby instances borrowed since Puppet Server started", nil)
+	e.newGauge("", "puppetserver_jruby_borrow_timeouts", "Number of requests which timed out waiting for a JRuby instance since Puppet Server started", nil)
+	e.newGauge("", "puppetserver_jruby_borrow_retries", "Number of JRuby instance borrow retries since Puppet Server started", nil)
+	e.newGauge("", "puppetserver_jruby_queue_limit_hits", "Number of requests rejected because too many were waiting for a JRuby instance since Puppet Server started", nil)
+	e.newGauge("", "puppetserver_http_requests", "Number of requests by route since Puppet Server started", []string{"route"})
+	e.newGauge("", "puppetserver_http_request_mean_seconds", "Mean duration of requests by route", []string{"route"})
+	e.newGauge("", "puppetserver_http_request_aggregate_seconds", "Total duration of requests by route since Puppet Server started", []string{"route"})
+}
+
+func (e *Exporter) initCAGauges() {
+	e.newGauge(e.nodeNamespace, "ca_certificates", "Number of certificates and certificate requests of the Puppet CA by state", []string{"state"})
+	e.newGauge(e.nodeNamespace, "ca_certificate_expiry_timestamp", "Expiry time of a certificate signed by the Puppet CA", []string{"name"})
+}
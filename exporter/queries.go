@@ -0,0 +1,116 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/output"
+)
+
+// Query is a user-defined PuppetDB query whose rows are exported as the
+// samples of a gauge
+type Query struct {
+	// Name is the full name of the gauge
+	Name string `json:"name"`
+	Help string `json:"help"`
+	// Endpoint is the endpoint of an AST query, PQL queries are sent to the
+	// root endpoint when empty
+	Endpoint string `json:"endpoint"`
+	Query    string `json:"query"`
+	// Value is the field holding the sample value, samples are set to 1
+	// when empty
+	Value string `json:"value"`
+	// Labels are the fields exported as labels
+	Labels []string `json:"labels"`
+}
+
+// queryKey returns the key of the gauge of a user-defined query, apart from
+// the keys of the built-in gauges
+func queryKey(q Query) string {
+	return "query:" + q.Name
+}
+
+// LoadQueries reads the user-defined queries from a JSON file holding an
+// array of queries
+func LoadQueries(path string) ([]Query, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var queries []Query
+	if err := json.Unmarshal(b, &queries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	names := map[string]struct{}{}
+	for _, q := range queries {
+		if !model.IsValidMetricName(model.LabelValue(q.Name)) {
+			return nil, fmt.Errorf("invalid query name %q", q.Name)
+		}
+		if _, ok := names[q.Name]; ok {
+			return nil, fmt.Errorf("query %s is defined more than once", q.Name)
+		}
+		names[q.Name] = struct{}{}
+		if q.Query == "" {
+			return nil, fmt.Errorf("query %s is empty", q.Name)
+		}
+	}
+	return queries, nil
+}
+
+// initQueryGauges creates the gauges of the user-defined queries
+func (e *Exporter) initQueryGauges() {
+	for _, q := range e.options.Queries {
+		help := q.Help
+		if help == "" {
+			help = fmt.Sprintf("PuppetDB query: %s", q.Query)
+		}
+		labelNames := make([]string, len(q.Labels))
+		for i, label := range q.Labels {
+			labelNames[i] = output.LabelName(label)
+		}
+
+		key := queryKey(q)
+		e.metrics[key] = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: q.Name, Help: help}, labelNames)
+		e.fqNames[key] = q.Name
+		e.labelSources[key] = labelNames
+	}
+}
+
+// runQueries runs the user-defined queries and appends their samples
+func (e *Exporter) runQueries(ctx context.Context) error {
+	var errs []error
+	for _, q := range e.options.Queries {
+		rows, err := e.client.Query(ctx, q.Endpoint, q.Query)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("query %s: %s", q.Name, err))
+			continue
+		}
+
+		key := queryKey(q)
+		for _, row := range rows {
+			value := 1.0
+			if q.Value != "" {
+				value, err = strconv.ParseFloat(output.Format(row[q.Value]), 64)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("query %s: failed to parse value: %s", q.Name, err))
+					break
+				}
+			}
+
+			labels := e.appendMetric(key, value)
+			for _, label := range q.Labels {
+				labels[output.LabelName(label)] = e.labels.intern(output.Format(row[label]))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
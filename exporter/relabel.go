@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/common/model"
+)
+
+// relabel returns the label names of a gauge once DropLabels are dropped and
+// RenameLabels renamed, along with the label each of them takes its value
+// from. Sources is nil when the label names are unchanged.
+func (e *Exporter) relabel(fqName string, labelNames []string) (names, sources []string, err error) {
+	if len(e.options.DropLabels) == 0 && len(e.options.RenameLabels) == 0 {
+		return labelNames, nil, nil
+	}
+
+	for _, label := range labelNames {
+		if slices.Contains(e.options.DropLabels, label) {
+			continue
+		}
+
+		exported := label
+		if to, ok := e.options.RenameLabels[label]; ok {
+			exported = to
+		}
+		if !model.LabelName(exported).IsValid() {
+			return nil, nil, fmt.Errorf("invalid label name %q renaming %s", exported, label)
+		}
+		if slices.Contains(names, exported) {
+			return nil, nil, fmt.Errorf("label %s of %s is renamed to an existing label", label, fqName)
+		}
+
+		names = append(names, exported)
+		sources = append(sources, label)
+	}
+	return names, sources, nil
+}
@@ -0,0 +1,63 @@
+package exporter
+
+import "github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+
+// resourceStates are the resources report metrics exported by the Resources
+// and ResourceTotals options
+var resourceStates = []string{"changed", "failed", "skipped", "corrective_change", "out_of_sync", "total"}
+
+// resourceValue returns the value of a resources report metric, or 0 when the
+// report does not have it
+func resourceValue(reportMetrics []puppetdb.ReportMetric, state string) float64 {
+	for _, reportMetric := range reportMetrics {
+		if reportMetric.Category == "resources" && reportMetric.Name == state {
+			return reportMetric.Value
+		}
+	}
+	return 0
+}
+
+// appendResources records the resource counts of a report, every state of
+// resourceStates is recorded so that the series stay stable
+func (e *Exporter) appendResources(reportMetrics []puppetdb.ReportMetric, host, environment string, facts map[string]interface{}) {
+	for _, state := range resourceStates {
+		labels := e.appendMetric("report_resources", resourceValue(reportMetrics, state))
+		labels["environment"] = environment
+		labels["host"] = host
+		labels["state"] = state
+		e.setFactLabels(labels, facts)
+	}
+}
+
+// resourceTotals sums the resource counts of the latest reports by
+// environment and state
+type resourceTotals map[string]map[string]float64
+
+func (t resourceTotals) add(environment string, reportMetrics []puppetdb.ReportMetric) {
+	if t[environment] == nil {
+		t[environment] = make(map[string]float64, len(resourceStates))
+	}
+	for _, state := range resourceStates {
+		t[environment][state] += resourceValue(reportMetrics, state)
+	}
+}
+
+// resourceTotalName returns the key of the gauge holding the total of a state
+func resourceTotalName(state string) string {
+	if state == "total" {
+		return "resources_count"
+	}
+	return "resources_" + state + "_count"
+}
+
+// appendResourceTotals records the fleet-wide resource counts
+func (e *Exporter) appendResourceTotals(totals resourceTotals) {
+	for environment, states := range totals {
+		for _, state := range resourceStates {
+			labels := e.appendMetric(resourceTotalName(state), states[state])
+			if e.options.ResourceTotalsByEnvironment {
+				labels["environment"] = environment
+			}
+		}
+	}
+}
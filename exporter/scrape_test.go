@@ -0,0 +1,95 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb/puppetdbtest"
+)
+
+// benchNodes is the size of the fleet the benchmarks scrape
+const benchNodes = 50000
+
+// memClient answers the nodes and report metrics queries from the data of
+// a fake PuppetDB without going through HTTP, so that the benchmarks measure
+// the exporter rather than the decoding of the responses. The other queries
+// are sent to the fake PuppetDB.
+type memClient struct {
+	puppetdb.Client
+	srv *puppetdbtest.Server
+}
+
+func (c *memClient) Nodes(context.Context) ([]puppetdb.Node, error) {
+	c.srv.Mu.Lock()
+	defer c.srv.Mu.Unlock()
+
+	return append([]puppetdb.Node(nil), c.srv.Nodes...), nil
+}
+
+func (c *memClient) ReportMetrics(_ context.Context, reportHash string) ([]puppetdb.ReportMetric, error) {
+	c.srv.Mu.Lock()
+	defer c.srv.Mu.Unlock()
+
+	return c.srv.ReportMetrics[reportHash], nil
+}
+
+// newBenchExporter returns an exporter scraping a fake fleet of benchNodes
+// nodes, and a function closing the fake PuppetDB
+func newBenchExporter(b *testing.B) (*Exporter, func()) {
+	b.Helper()
+
+	srv := puppetdbtest.NewMock(benchNodes, 0.05)
+	client, err := puppetdb.NewClient(srv.Options())
+	if err != nil {
+		srv.Close()
+		b.Fatalf("failed to create client: %s", err)
+	}
+
+	e, err := NewPuppetDBExporter(srv.Options(), &Options{
+		Client: &memClient{Client: client, srv: srv},
+		Categories: map[string]struct{}{
+			"changes": {}, "events": {}, "resources": {}, "time": {},
+		},
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		srv.Close()
+		b.Fatalf("failed to create exporter: %s", err)
+	}
+	return e, srv.Close
+}
+
+func BenchmarkScrape(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+	e, closeServer := newBenchExporter(b)
+	defer closeServer()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if err := e.scrape(context.Background(), 2*time.Hour, false); err != nil {
+			b.Fatalf("failed to scrape: %s", err)
+		}
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+	e, closeServer := newBenchExporter(b)
+	defer closeServer()
+
+	if err := e.scrape(context.Background(), 2*time.Hour, false); err != nil {
+		b.Fatalf("failed to scrape: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		e.publishReports(false)
+	}
+}
@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// TargetGroup is a Prometheus service discovery target group
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// discovery holds the target groups built from the nodes of the latest cycle
+type discovery struct {
+	mu     sync.Mutex
+	groups []TargetGroup
+}
+
+// sdLabelPrefix prefixes the labels of the discovered targets, which are
+// available to relabeling
+const sdLabelPrefix = "__meta_puppetdb_"
+
+// sdTarget returns the service discovery target of a node, and false when
+// the node is not discovered
+func (e *Exporter) sdTarget(node puppetdb.Node) (string, bool) {
+	if !e.included(node.Certname) || node.Deactivated != "" || node.Expired != "" {
+		return "", false
+	}
+
+	target := node.Certname
+	if e.options.SDPort > 0 {
+		target += ":" + strconv.Itoa(e.options.SDPort)
+	}
+	return target, true
+}
+
+// updateTargets builds a target group from each active node
+func (e *Exporter) updateTargets(nodes []puppetdb.Node, facts nodeFacts) {
+	groups := make([]TargetGroup, 0, len(nodes))
+	for _, node := range nodes {
+		target, ok := e.sdTarget(node)
+		if !ok {
+			continue
+		}
+
+		labels := map[string]string{
+			sdLabelPrefix + "certname":    node.Certname,
+			sdLabelPrefix + "host":        e.host(node.Certname),
+			sdLabelPrefix + "environment": node.ReportEnvironment,
+		}
+		for _, fact := range e.options.SDFacts {
+			labels[sdLabelPrefix+"fact_"+invalidNameChars.ReplaceAllString(fact, "_")] = factString(facts[node.Certname][fact])
+		}
+
+		groups = append(groups, TargetGroup{
+			Targets: []string{target},
+			Labels:  labels,
+		})
+	}
+
+	e.sd.mu.Lock()
+	e.sd.groups = groups
+	e.sd.mu.Unlock()
+}
+
+// writeTargetsFile writes a target group from each active node to SDFile in
+// the file_sd format, with the environment and SDFileLabels facts as labels.
+// The file is replaced atomically, and only when its content changes.
+func (e *Exporter) writeTargetsFile(nodes []puppetdb.Node, facts nodeFacts) error {
+	groups := make([]TargetGroup, 0, len(nodes))
+	for _, node := range nodes {
+		target, ok := e.sdTarget(node)
+		if !ok {
+			continue
+		}
+
+		labels := map[string]string{
+			"environment": node.ReportEnvironment,
+		}
+		for fact, label := range e.options.SDFileLabels {
+			labels[label] = factString(facts[node.Certname][fact])
+		}
+
+		groups = append(groups, TargetGroup{
+			Targets: []string{target},
+			Labels:  labels,
+		})
+	}
+
+	b, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, e.sdFile) {
+		return nil
+	}
+
+	if err := writeFile(e.options.SDFile, b); err != nil {
+		return err
+	}
+
+	e.sdFile = b
+	return nil
+}
+
+// writeFile replaces the content of the file at once, so that readers never
+// see it partially written
+func writeFile(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// targetGroups returns the target groups of the latest cycle
+func (e *Exporter) targetGroups() []TargetGroup {
+	e.sd.mu.Lock()
+	defer e.sd.mu.Unlock()
+
+	if e.sd.groups == nil {
+		return []TargetGroup{}
+	}
+	return e.sd.groups
+}
+
+// SDHandler serves the nodes of the latest cycle in the Prometheus HTTP
+// service discovery format
+func (e *Exporter) SDHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.sd == nil {
+			http.Error(w, "service discovery is disabled", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.targetGroups())
+	})
+}
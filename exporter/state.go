@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// savedState is the content of the state file
+type savedState struct {
+	// Time is the end of the scrape cycle the metrics were collected by
+	Time    time.Time                `json:"time"`
+	Metrics map[string][]savedMetric `json:"metrics"`
+	// Categories are the report metrics categories discovered by the run
+	Categories []string `json:"categories,omitempty"`
+}
+
+// savedMetric is a metric of the state file
+type savedMetric struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// saveState writes the metrics of the latest cycle to StateFile
+func (e *Exporter) saveState() error {
+	state := savedState{
+		Time:       time.Now(),
+		Metrics:    make(map[string][]savedMetric, len(e.reports)),
+		Categories: e.autoCategories,
+	}
+	for k, ms := range e.reports {
+		if len(ms) == 0 {
+			continue
+		}
+		saved := make([]savedMetric, len(ms))
+		for i, m := range ms {
+			saved[i] = savedMetric{Labels: m.labels, Value: m.value}
+		}
+		state.Metrics[k] = saved
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFile(e.options.StateFile, b)
+}
+
+// LoadState publishes the metrics saved to StateFile by a previous run, so
+// that they are served until a scrape cycle fetches the nodes. A missing
+// state file is not an error.
+func (e *Exporter) LoadState() error {
+	b, err := os.ReadFile(e.options.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %s", err)
+	}
+
+	var state savedState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("failed to parse state file: %s", err)
+	}
+
+	// The gauges of the categories discovered by the previous run are
+	// created before their metrics are restored
+	for _, category := range state.Categories {
+		e.exportCategory(category)
+	}
+	e.addCategories()
+
+	series := 0
+	for k, saved := range state.Metrics {
+		if _, ok := e.metrics[k]; !ok {
+			continue
+		}
+		ms := make([]metric, len(saved))
+		for i, m := range saved {
+			ms[i] = metric{labels: prometheus.Labels(m.Labels), value: m.Value}
+		}
+		e.reports[k] = ms
+		series += len(ms)
+	}
+
+	e.publishReports(e.options.AggregateOnly || e.seriesLimitExceeded())
+	e.restored = true
+	e.restoredTime.Set(float64(state.Time.Unix()))
+	log.Infof("%d series restored from the state of %s", series, state.Time.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// boolValue converts a boolean to a sample value
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// checkVersion detects the version of the PuppetDB every cycle, so that
+// upgrades and failovers are noticed and queries adapted to older versions
+func (e *Exporter) checkVersion(ctx context.Context) {
+	version, err := e.client.DetectVersion(ctx)
+	if err != nil {
+		log.Warnf("failed to detect PuppetDB version: %s", err)
+		return
+	}
+
+	labels := e.appendMetric("server_info", 1)
+	labels["version"] = e.labels.intern(version)
+}
+
+// checkStatus records the status of the PuppetDB service
+func (e *Exporter) checkStatus(ctx context.Context) {
+	status, err := e.client.Status(ctx)
+	if err != nil {
+		log.Errorf("failed to check PuppetDB status: %s", err)
+		e.appendMetric("service_up", 0)
+		return
+	}
+
+	e.appendMetric("service_up", 1)
+	e.appendMetric("service_running", boolValue(status.Running()))
+
+	labels := e.appendMetric("service_info", 1)
+	labels["version"] = e.labels.intern(status.ServiceVersion)
+	labels["state"] = e.labels.intern(status.State)
+
+	e.appendMetric("maintenance_mode", boolValue(status.Status.MaintenanceMode))
+	e.appendMetric("read_db_up", boolValue(status.Status.ReadDBUp))
+	e.appendMetric("write_db_up", boolValue(status.Status.WriteDBUp))
+	e.appendMetric("queue_depth", float64(status.Status.QueueDepth))
+}
+
+func (e *Exporter) initStatusGauges() {
+	e.newGauge(e.namespace, "service_up", "Whether the PuppetDB status API could be reached", nil)
+	e.newGauge(e.namespace, "service_running", "Whether the PuppetDB service is running and not in maintenance mode", nil)
+	e.newGauge(e.namespace, "service_info", "Version and state of the PuppetDB service", []string{"version", "state"})
+	e.newGauge(e.namespace, "maintenance_mode", "Whether the PuppetDB service is in maintenance mode", nil)
+	e.newGauge(e.namespace, "read_db_up", "Whether the PuppetDB read database is up", nil)
+	e.newGauge(e.namespace, "write_db_up", "Whether the PuppetDB write database is up", nil)
+	e.newGauge(e.namespace, "queue_depth", "Number of commands waiting to be processed by PuppetDB", nil)
+}
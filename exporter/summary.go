@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScrapeSummary summarizes the latest scrape cycle
+type ScrapeSummary struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	// Stages are the durations of the stages of the cycle in seconds
+	Stages map[string]float64 `json:"stages_seconds"`
+	Nodes  int                `json:"nodes"`
+	// Statuses counts the nodes by status
+	Statuses   map[string]int   `json:"statuses"`
+	Unreported []UnreportedNode `json:"unreported"`
+	Errors     []string         `json:"errors"`
+}
+
+// UnreportedNode is a node considered unreported during a scrape cycle
+type UnreportedNode struct {
+	Certname string `json:"certname"`
+	// Host is the host label of the node
+	Host        string `json:"host"`
+	Environment string `json:"environment"`
+	Reason      string `json:"reason"`
+	// LatestReport is nil when the node never reported
+	LatestReport *time.Time `json:"latest_report"`
+}
+
+// Unreported returns the unreported nodes as a scrape cycle finds them,
+// with the same certname filters, shard and unreported thresholds, silenced
+// nodes being left out
+func (e *Exporter) Unreported(ctx context.Context, unreportedDuration time.Duration) ([]UnreportedNode, error) {
+	nodes, err := e.client.Nodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %s", err)
+	}
+	facts, err := e.fetchFacts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get facts: %s", err)
+	}
+
+	var unreported []UnreportedNode
+	for _, node := range nodes {
+		if !e.included(node.Certname) || e.silenced(facts[node.Certname]) {
+			continue
+		}
+
+		threshold := e.unreportedThreshold(node.Certname, facts[node.Certname], unreportedDuration)
+		status, reason, latestReport := NodeStatus(node, threshold)
+		if status != StatusUnreported {
+			continue
+		}
+		u := UnreportedNode{
+			Certname:    node.Certname,
+			Host:        e.host(node.Certname),
+			Environment: node.ReportEnvironment,
+			Reason:      reason,
+		}
+		if !latestReport.IsZero() {
+			u.LatestReport = &latestReport
+		}
+		unreported = append(unreported, u)
+	}
+	sort.Slice(unreported, func(i, j int) bool { return unreported[i].Certname < unreported[j].Certname })
+	return unreported, nil
+}
+
+// lastScrape holds the summary of the latest scrape cycle
+type lastScrape struct {
+	mu      sync.Mutex
+	summary ScrapeSummary
+}
+
+func (l *lastScrape) set(summary ScrapeSummary) {
+	sort.Slice(summary.Unreported, func(i, j int) bool {
+		return summary.Unreported[i].Certname < summary.Unreported[j].Certname
+	})
+
+	l.mu.Lock()
+	l.summary = summary
+	l.mu.Unlock()
+}
+
+// LastScrapeHandler serves the summary of the latest scrape cycle as JSON
+func (e *Exporter) LastScrapeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.last.mu.Lock()
+		summary := e.last.summary
+		e.last.mu.Unlock()
+
+		if summary.Time.IsZero() {
+			http.Error(w, "no scrape cycle completed yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	})
+}
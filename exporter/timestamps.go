@@ -0,0 +1,40 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// timestampedGauge exports the samples of a gauge holding Unix timestamps
+// with the timestamp they hold as sample timestamp. Samples without a
+// timestamp, e.g. of nodes which never reported, are exported as is.
+type timestampedGauge struct {
+	*prometheus.GaugeVec
+}
+
+// Collect implements prometheus.Collector
+func (g timestampedGauge) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		g.GaugeVec.Collect(metrics)
+		close(metrics)
+	}()
+
+	for m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			log.Errorf("failed to read gauge: %s", err)
+			continue
+		}
+
+		value := pb.GetGauge().GetValue()
+		if value <= 0 {
+			ch <- m
+			continue
+		}
+		ch <- prometheus.NewMetricWithTimestamp(time.Unix(int64(value), 0), m)
+	}
+}
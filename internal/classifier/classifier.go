@@ -0,0 +1,163 @@
+// Package classifier for PE node classifier data retrieval
+package classifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// Classifier stores informations used to connect to the PE node classifier
+type Classifier struct {
+	options *Options
+	client  *http.Client
+	baseURL string
+}
+
+// Options contains the options used to connect to the node classifier
+type Options struct {
+	// URL is the base URL of the classifier API, e.g.
+	// https://pe-console:4433/classifier-api
+	URL        string
+	CertPath   string
+	CACertPath string
+	KeyPath    string
+	SSLVerify  bool
+	// Credentials replace CertPath and KeyPath when set, e.g. fetched from
+	// Vault
+	Credentials *tlsconfig.Credentials
+	// Timeout bounds the duration of requests, unbounded when 0
+	Timeout time.Duration
+}
+
+// Group is a node group returned by the classifier
+type Group struct {
+	ID     string      `json:"id"`
+	Name   string      `json:"name"`
+	Parent string      `json:"parent"`
+	Rule   interface{} `json:"rule"`
+}
+
+// NewClient creates a new node classifier client
+func NewClient(options *Options) (*Classifier, error) {
+	classifierURL, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse classifier URL: %v", err)
+	}
+
+	transport := &http.Transport{}
+	if classifierURL.Scheme == "https" {
+		transport.TLSClientConfig, err = tlsconfig.Load(&tlsconfig.Files{
+			CertPath:           options.CertPath,
+			KeyPath:            options.KeyPath,
+			CACertPath:         options.CACertPath,
+			InsecureSkipVerify: !options.SSLVerify,
+			Credentials:        options.Credentials,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Classifier{
+		options: options,
+		client:  &http.Client{Transport: transport},
+		baseURL: strings.TrimRight(options.URL, "/"),
+	}, nil
+}
+
+// Groups returns every node group
+func (c *Classifier) Groups(ctx context.Context) (groups []Group, err error) {
+	err = c.get(ctx, "/v1/groups", &groups)
+	if err != nil {
+		err = fmt.Errorf("failed to get node groups: %s", err)
+		return
+	}
+	return
+}
+
+// PinnedGroups returns the names of the groups each node is pinned to, sorted,
+// by certname. Nodes are pinned with a ["=", "name", certname] clause in the
+// group's rule.
+func PinnedGroups(groups []Group) map[string][]string {
+	pinned := map[string][]string{}
+	for _, group := range groups {
+		for _, certname := range pinnedNodes(group.Rule, nil) {
+			if len(pinned[certname]) == 0 || pinned[certname][len(pinned[certname])-1] != group.Name {
+				pinned[certname] = append(pinned[certname], group.Name)
+			}
+		}
+	}
+	for _, names := range pinned {
+		sort.Strings(names)
+	}
+	return pinned
+}
+
+// pinnedNodes appends the certnames pinned by the rule to certnames
+func pinnedNodes(rule interface{}, certnames []string) []string {
+	clause, ok := rule.([]interface{})
+	if !ok || len(clause) == 0 {
+		return certnames
+	}
+
+	switch clause[0] {
+	case "or", "and", "not":
+		for _, sub := range clause[1:] {
+			certnames = pinnedNodes(sub, certnames)
+		}
+	case "=":
+		if len(clause) == 3 && clause[1] == "name" {
+			if certname, ok := clause[2].(string); ok {
+				certnames = append(certnames, certname)
+			}
+		}
+	}
+	return certnames
+}
+
+// get calls the given path of the classifier API and decodes its JSON
+// response into object
+func (c *Classifier) get(ctx context.Context, path string, object interface{}) (err error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to build request: %s", err)
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to call API: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read response: %s", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+		return
+	}
+	err = json.Unmarshal(body, object)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal: %s", err)
+		return
+	}
+	return
+}
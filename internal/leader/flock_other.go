@@ -0,0 +1,13 @@
+//go:build !unix
+
+package leader
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLock is not supported on this platform
+func tryLock(file *os.File) (bool, error) {
+	return false, errors.New("file locks are not supported on this platform")
+}
@@ -0,0 +1,52 @@
+// Package leader elects a single active exporter among the instances sharing
+// a lock file
+package leader
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Lock is an exclusive lock on a file, held by the leader until it exits
+type Lock struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// New returns the lock of the file at path, which is created when missing.
+// The file system must support advisory locks across the instances, which
+// network file systems may not.
+func New(path string) *Lock {
+	return &Lock{path: path}
+}
+
+// TryAcquire takes the lock unless another instance holds it, and reports
+// whether this instance is the leader. The lock is kept once acquired.
+func (l *Lock) TryAcquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open lock file: %s", err)
+	}
+
+	ok, err := tryLock(file)
+	if err != nil || !ok {
+		file.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to lock %s: %s", l.path, err)
+		}
+		return false, nil
+	}
+
+	l.file = file
+	return true, nil
+}
@@ -0,0 +1,186 @@
+// Package output renders command results as JSON, text tables, CSV or Prometheus exposition format
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Supported output formats
+const (
+	FormatJSON  = "json"
+	FormatTable = "table"
+	FormatCSV   = "csv"
+	FormatProm  = "prom"
+)
+
+// Table is a list of rows sharing the same columns
+type Table struct {
+	// Name and Help describe the metric written by the prom format
+	Name string
+	Help string
+	// Value is the column holding the sample value in the prom format, every
+	// other column becomes a label. When empty, samples are set to 1.
+	Value   string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// LabelName turns a column name into a valid label name
+func LabelName(column string) string {
+	return invalidLabelChars.ReplaceAllString(column, "_")
+}
+
+// Write renders the table to w in the given format
+func Write(w io.Writer, format string, t *Table) error {
+	switch format {
+	case FormatJSON:
+		return writeJSON(w, t)
+	case FormatTable:
+		return writeTable(w, t)
+	case FormatCSV:
+		return writeCSV(w, t)
+	case FormatProm:
+		return writeProm(w, t)
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func writeJSON(w io.Writer, t *Table) error {
+	objects := make([]map[string]interface{}, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		object := make(map[string]interface{}, len(t.Columns))
+		for i, column := range t.Columns {
+			object[column] = row[i]
+		}
+		objects = append(objects, object)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(objects)
+}
+
+func writeTable(w io.Writer, t *Table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, column := range t.Columns {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, column)
+	}
+	fmt.Fprintln(tw)
+
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, Format(cell))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, t *Table) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(t.Columns); err != nil {
+		return err
+	}
+
+	record := make([]string, len(t.Columns))
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			record[i] = Format(cell)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeProm(w io.Writer, t *Table) error {
+	value := -1
+	var labelNames []string
+	for i, column := range t.Columns {
+		if column == t.Value {
+			value = i
+			continue
+		}
+		labelNames = append(labelNames, LabelName(column))
+	}
+	if t.Value != "" && value < 0 {
+		return fmt.Errorf("value column %q not found", t.Value)
+	}
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: t.Name,
+		Help: t.Help,
+	}, labelNames)
+
+	labelValues := make([]string, 0, len(labelNames))
+	for _, row := range t.Rows {
+		v := 1.0
+		labelValues = labelValues[:0]
+		for i, cell := range row {
+			if i != value {
+				labelValues = append(labelValues, Format(cell))
+				continue
+			}
+
+			var err error
+			v, err = strconv.ParseFloat(Format(cell), 64)
+			if err != nil {
+				return fmt.Errorf("failed to parse value of column %s: %s", t.Value, err)
+			}
+		}
+		gauge.WithLabelValues(labelValues...).Set(v)
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(gauge); err != nil {
+		return err
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Format renders a cell as a string, structured values are rendered as JSON
+func Format(cell interface{}) string {
+	switch v := cell.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+	return fmt.Sprint(cell)
+}
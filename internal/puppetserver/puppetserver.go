@@ -0,0 +1,265 @@
+// Package puppetserver for Puppet Server status retrieval
+package puppetserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/secret"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// PuppetServer stores informations used to connect to a Puppet Server
+type PuppetServer struct {
+	options *Options
+	client  *http.Client
+	baseURL string
+}
+
+// Options contains the options used to connect to a Puppet Server
+type Options struct {
+	// URL is the base URL of the Puppet Server, e.g. https://puppet:8140
+	URL        string
+	CertPath   string
+	CACertPath string
+	KeyPath    string
+	SSLVerify  bool
+	// Credentials replace CertPath and KeyPath when set, e.g. fetched from
+	// Vault
+	Credentials *tlsconfig.Credentials
+	// Token is an RBAC token sent along with requests, if any. TokenPath
+	// locates a file holding it instead, read for every request.
+	Token     string
+	TokenPath string
+	// Timeout bounds the duration of requests, unbounded when 0
+	Timeout time.Duration
+}
+
+// ServiceStatus is the status of a Puppet Server service returned by the
+// status API
+type ServiceStatus struct {
+	ServiceVersion string          `json:"service_version"`
+	State          string          `json:"state"`
+	Status         json.RawMessage `json:"status"`
+}
+
+// Services maps the names of the Puppet Server services to their status
+type Services map[string]ServiceStatus
+
+// JRubyMetrics are the metrics of the JRuby pool, found in the status of
+// the jruby-metrics service at the debug level
+type JRubyMetrics struct {
+	NumJRubies         int     `json:"num-jrubies"`
+	NumFreeJRubies     int     `json:"num-free-jrubies"`
+	AverageBorrowTime  float64 `json:"average-borrow-time"`
+	AverageWaitTime    float64 `json:"average-wait-time"`
+	BorrowCount        int     `json:"borrow-count"`
+	BorrowTimeoutCount int     `json:"borrow-timeout-count"`
+	BorrowRetryCount   int     `json:"borrow-retry-count"`
+	RequestedCount     int     `json:"requested-count"`
+	QueueLimitHitCount int     `json:"queue-limit-hit-count"`
+}
+
+// HTTPMetric holds the request metrics of a route, found in the status of the
+// master service at the debug level. Durations are in milliseconds.
+type HTTPMetric struct {
+	RouteID   string  `json:"route-id"`
+	Count     int     `json:"count"`
+	Mean      float64 `json:"mean"`
+	Aggregate float64 `json:"aggregate"`
+}
+
+// CertificateStatus is the status of a certificate returned by the CA API
+type CertificateStatus struct {
+	Name string `json:"name"`
+	// State is requested, signed or revoked
+	State       string `json:"state"`
+	Fingerprint string `json:"fingerprint"`
+	NotBefore   string `json:"not_before"`
+	NotAfter    string `json:"not_after"`
+}
+
+// Deploy is an environment deployment returned by the Code Manager API
+type Deploy struct {
+	Environment     string `json:"environment"`
+	Date            string `json:"date"`
+	DeploySignature string `json:"deploy-signature"`
+	QueuedAt        string `json:"queued-at"`
+}
+
+// DeployStatus is the deployment status returned by the Code Manager API
+type DeployStatus struct {
+	DeploysStatus struct {
+		New       []Deploy `json:"new"`
+		Queued    []Deploy `json:"queued"`
+		Deploying []Deploy `json:"deploying"`
+		Failed    []Deploy `json:"failed"`
+	} `json:"deploys-status"`
+	FileSyncStorageStatus struct {
+		Deployed []Deploy `json:"deployed"`
+	} `json:"file-sync-storage-status"`
+	FileSyncClientStatus struct {
+		AllSynced bool `json:"all-synced"`
+	} `json:"file-sync-client-status"`
+}
+
+// NewClient creates a new Puppet Server client
+func NewClient(options *Options) (*PuppetServer, error) {
+	serverURL, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Puppet Server URL: %v", err)
+	}
+
+	transport := &http.Transport{}
+	if serverURL.Scheme == "https" {
+		var tlsConfig *tls.Config
+		tlsConfig, err = tlsconfig.Load(&tlsconfig.Files{
+			CertPath:           options.CertPath,
+			KeyPath:            options.KeyPath,
+			CACertPath:         options.CACertPath,
+			InsecureSkipVerify: !options.SSLVerify,
+			Credentials:        options.Credentials,
+		})
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &PuppetServer{
+		options: options,
+		client:  &http.Client{Transport: transport},
+		baseURL: strings.TrimRight(options.URL, "/"),
+	}, nil
+}
+
+// URL returns the base URL of the Puppet Server
+func (p *PuppetServer) URL() string {
+	return p.options.URL
+}
+
+// Services returns the status of every service of the Puppet Server, at the
+// debug level which includes the JRuby and HTTP metrics
+func (p *PuppetServer) Services(ctx context.Context) (services Services, err error) {
+	err = p.get(ctx, "/status/v1/services?level=debug", &services)
+	if err != nil {
+		err = fmt.Errorf("failed to get services status: %s", err)
+		return
+	}
+	return
+}
+
+// CertificateStatuses returns the status of every certificate and certificate
+// request of the Puppet CA
+func (p *PuppetServer) CertificateStatuses(ctx context.Context) (statuses []CertificateStatus, err error) {
+	err = p.get(ctx, "/puppet-ca/v1/certificate_statuses/any_key", &statuses)
+	if err != nil {
+		err = fmt.Errorf("failed to get certificate statuses: %s", err)
+		return
+	}
+	return
+}
+
+// DeployStatus returns the status of the Code Manager deployments, the
+// client must be created with the URL of the Code Manager API, e.g.
+// https://puppet:8170/code-manager
+func (p *PuppetServer) DeployStatus(ctx context.Context) (status *DeployStatus, err error) {
+	status = &DeployStatus{}
+	err = p.get(ctx, "/v1/deploys/status", status)
+	if err != nil {
+		err = fmt.Errorf("failed to get deploys status: %s", err)
+		return nil, err
+	}
+	return
+}
+
+// JRubyMetrics extracts the JRuby pool metrics from the services status, nil
+// when the jruby-metrics service is missing
+func (s Services) JRubyMetrics() (*JRubyMetrics, error) {
+	service, ok := s["jruby-metrics"]
+	if !ok {
+		return nil, nil
+	}
+
+	var status struct {
+		Experimental struct {
+			Metrics *JRubyMetrics `json:"metrics"`
+		} `json:"experimental"`
+	}
+	if err := json.Unmarshal(service.Status, &status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JRuby metrics: %s", err)
+	}
+	return status.Experimental.Metrics, nil
+}
+
+// HTTPMetrics extracts the request metrics by route from the services status
+func (s Services) HTTPMetrics() ([]HTTPMetric, error) {
+	service, ok := s["master"]
+	if !ok {
+		return nil, nil
+	}
+
+	var status struct {
+		Experimental struct {
+			HTTPMetrics []HTTPMetric `json:"http-metrics"`
+		} `json:"experimental"`
+	}
+	if err := json.Unmarshal(service.Status, &status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal HTTP metrics: %s", err)
+	}
+	return status.Experimental.HTTPMetrics, nil
+}
+
+// get calls the given path of the Puppet Server and decodes its JSON response
+// into object
+func (p *PuppetServer) get(ctx context.Context, path string, object interface{}) (err error) {
+	if p.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+path, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to build request: %s", err)
+		return
+	}
+	token := p.options.Token
+	if p.options.TokenPath != "" {
+		if token, err = secret.Read(p.options.TokenPath); err != nil {
+			return
+		}
+	}
+	if token != "" {
+		req.Header.Set("X-Authentication", token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to call API: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read response: %s", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+		return
+	}
+	err = json.Unmarshal(body, object)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal: %s", err)
+		return
+	}
+	return
+}
@@ -0,0 +1,226 @@
+// Package remotewrite pushes gathered metrics with the Prometheus remote write
+// protocol, e.g. to Mimir, Thanos or VictoriaMetrics
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/secret"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// Client pushes the metrics of a gatherer to a remote write endpoint
+type Client struct {
+	options *Options
+	client  *http.Client
+}
+
+// Options contains the options used to push to a remote write endpoint
+type Options struct {
+	// URL is the remote write endpoint, e.g. http://mimir:9009/api/v1/push
+	URL      string
+	Username string
+	Password string
+	// PasswordPath locates a file holding the password instead, read for
+	// every push
+	PasswordPath string
+	// CertPath and KeyPath locate an optional client certificate
+	CertPath   string
+	KeyPath    string
+	CACertPath string
+	SSLVerify  bool
+	// Labels are added to every series which lacks them
+	Labels map[string]string
+	// Timeout bounds the duration of requests, unbounded when 0
+	Timeout  time.Duration
+	Gatherer prometheus.Gatherer
+}
+
+// NewClient creates a new remote write client
+func NewClient(options *Options) (*Client, error) {
+	endpoint, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse remote write URL: %v", err)
+	}
+
+	transport := &http.Transport{}
+	if endpoint.Scheme == "https" {
+		files := &tlsconfig.Files{
+			CertPath:           options.CertPath,
+			KeyPath:            options.KeyPath,
+			CACertPath:         options.CACertPath,
+			InsecureSkipVerify: !options.SSLVerify,
+		}
+
+		var tlsConfig *tls.Config
+		if options.CertPath != "" {
+			tlsConfig, err = tlsconfig.Load(files)
+		} else {
+			tlsConfig, err = tlsconfig.LoadCA(files)
+		}
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Client{
+		options: options,
+		client:  &http.Client{Transport: transport, Timeout: options.Timeout},
+	}, nil
+}
+
+// Push gathers the metrics and writes them to the remote write endpoint,
+// timestamped with the current time unless they carry their own
+func (c *Client) Push(ctx context.Context) error {
+	families, err := c.options.Gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %s", err)
+	}
+
+	series := c.timeSeries(families, time.Now().UnixMilli())
+	body := encodeSnappy(encodeWriteRequest(series))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "prometheus-puppetdb-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if c.options.Username != "" {
+		password := c.options.Password
+		if c.options.PasswordPath != "" {
+			if password, err = secret.Read(c.options.PasswordPath); err != nil {
+				return err
+			}
+		}
+		req.SetBasicAuth(c.options.Username, password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// label is a label of a time series
+type label struct {
+	name, value string
+}
+
+// timeSeries is a single sample of a series
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// timeSeries flattens the metric families into series, histograms and
+// summaries being split into their bucket, quantile, sum and count series
+func (c *Client) timeSeries(families []*dto.MetricFamily, now int64) []timeSeries {
+	var series []timeSeries
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			timestamp := now
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...label) {
+				series = append(series, timeSeries{
+					labels:    c.labels(name+suffix, m.GetLabel(), extra...),
+					value:     value,
+					timestamp: timestamp,
+				})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.GetBucket() {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				if !inf {
+					add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				}
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// labels returns the sorted labels of a series, the configured labels
+// filling in the ones the metric lacks
+func (c *Client) labels(name string, pairs []*dto.LabelPair, extra ...label) []label {
+	labels := make([]label, 0, len(pairs)+len(extra)+len(c.options.Labels)+1)
+	labels = append(labels, label{"__name__", name})
+	seen := make(map[string]struct{}, len(pairs)+len(extra))
+	for _, p := range pairs {
+		labels = append(labels, label{p.GetName(), p.GetValue()})
+		seen[p.GetName()] = struct{}{}
+	}
+	for _, l := range extra {
+		labels = append(labels, l)
+		seen[l.name] = struct{}{}
+	}
+	for name, value := range c.options.Labels {
+		if _, ok := seen[name]; !ok {
+			labels = append(labels, label{name, value})
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	return labels
+}
+
+// formatFloat formats a bucket bound or quantile the way Prometheus does
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,150 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/secret"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// Consul resolves the PuppetDB servers from the healthy instances of a Consul
+// service
+type Consul struct {
+	options *ConsulOptions
+	client  *http.Client
+}
+
+// ConsulOptions contains the options used to query the Consul catalog
+type ConsulOptions struct {
+	// Address is the Consul HTTP API address, e.g. http://127.0.0.1:8500
+	Address string
+	// Service is the name of the PuppetDB service, Tag optionally restricts
+	// its instances
+	Service    string
+	Tag        string
+	Datacenter string
+	Token      string
+	// TokenPath locates a file holding the token instead, read for every
+	// resolution
+	TokenPath  string
+	CertPath   string
+	KeyPath    string
+	CACertPath string
+	SSLVerify  bool
+	Timeout    time.Duration
+	// Template is the PuppetDB URL whose host and port are replaced by the
+	// ones of the service instances
+	Template *url.URL
+}
+
+// consulEntry is an instance of the service returned by the health API
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// NewConsul creates a new Consul resolver
+func NewConsul(options *ConsulOptions) (*Consul, error) {
+	address, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Consul address: %v", err)
+	}
+
+	transport := &http.Transport{}
+	if address.Scheme == "https" {
+		files := &tlsconfig.Files{
+			CertPath:           options.CertPath,
+			KeyPath:            options.KeyPath,
+			CACertPath:         options.CACertPath,
+			InsecureSkipVerify: !options.SSLVerify,
+		}
+
+		var tlsConfig *tls.Config
+		if options.CertPath != "" {
+			tlsConfig, err = tlsconfig.Load(files)
+		} else {
+			tlsConfig, err = tlsconfig.LoadCA(files)
+		}
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Consul{
+		options: options,
+		client:  &http.Client{Transport: transport, Timeout: options.Timeout},
+	}, nil
+}
+
+// Resolve implements Resolver. Only the instances passing their health checks
+// are returned, ordered by address.
+func (c *Consul) Resolve(ctx context.Context) ([]string, error) {
+	params := url.Values{}
+	params.Set("passing", "true")
+	if c.options.Tag != "" {
+		params.Set("tag", c.options.Tag)
+	}
+	if c.options.Datacenter != "" {
+		params.Set("dc", c.options.Datacenter)
+	}
+	myurl := fmt.Sprintf("%s/v1/health/service/%s?%s", c.options.Address, url.PathEscape(c.options.Service), params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, myurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := c.options.Token
+	if c.options.TokenPath != "" {
+		if token, err = secret.Read(c.options.TokenPath); err != nil {
+			return nil, err
+		}
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Consul: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Consul response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query Consul: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var entries []consulEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Consul response: %s", err)
+	}
+
+	urls := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		urls = append(urls, withHost(c.options.Template, host, e.Service.Port))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
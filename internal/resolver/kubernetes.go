@@ -0,0 +1,157 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials of the pod's service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes resolves the PuppetDB servers from the ready endpoints of a
+// Kubernetes service, through the API server of the cluster the exporter
+// runs in
+type Kubernetes struct {
+	namespace, service, portName string
+	apiServer                    string
+	template                     *url.URL
+	client                       *http.Client
+}
+
+// endpointSlice is an EndpointSlice returned by the discovery API
+type endpointSlice struct {
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+// NewKubernetes creates a resolver of the endpoints of the service, given as
+// namespace/name or as a name in the namespace of the pod. The port named
+// portName is used, the first one when empty, and replaces the host and port
+// of the template PuppetDB URL along the endpoint address.
+func NewKubernetes(service, portName string, template *url.URL, timeout time.Duration) (*Kubernetes, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+
+	namespace, name, ok := strings.Cut(service, "/")
+	if !ok {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %s", err)
+		}
+		namespace, name = strings.TrimSpace(string(ns)), service
+	}
+
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cluster ca certificate: %s", err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to parse cluster ca certificate")
+	}
+
+	return &Kubernetes{
+		namespace: namespace,
+		service:   name,
+		portName:  portName,
+		apiServer: "https://" + net.JoinHostPort(host, port),
+		template:  template,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}},
+			Timeout:   timeout,
+		},
+	}, nil
+}
+
+// Resolve implements Resolver. Only the ready endpoints are returned, ordered
+// by address.
+func (k *Kubernetes) Resolve(ctx context.Context) ([]string, error) {
+	// Projected service account tokens are rotated, hence read every time
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %s", err)
+	}
+
+	params := url.Values{}
+	params.Set("labelSelector", "kubernetes.io/service-name="+k.service)
+	myurl := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", k.apiServer, url.PathEscape(k.namespace), params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, myurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Kubernetes API: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Kubernetes API response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query Kubernetes API: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var list struct {
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Kubernetes API response: %s", err)
+	}
+
+	var urls []string
+	for _, slice := range list.Items {
+		port := k.port(slice)
+		if port == 0 {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			// A nil ready condition means ready
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, address := range e.Addresses {
+				urls = append(urls, withHost(k.template, address, port))
+			}
+		}
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// port returns the port of the endpoints of the slice, 0 when it lacks the
+// configured one
+func (k *Kubernetes) port(slice endpointSlice) int {
+	for _, p := range slice.Ports {
+		if k.portName == "" || p.Name == k.portName {
+			return p.Port
+		}
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+// Package resolver discovers the PuppetDB servers to query in dynamic
+// environments, instead of hardcoded URLs
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver returns the URLs of the PuppetDB servers, in failover priority
+// order
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// SRV resolves the PuppetDB servers from a DNS SRV record
+type SRV struct {
+	// Record is the name of the SRV record, e.g. _puppetdb._tcp.example.com
+	Record string
+	// Template is the PuppetDB URL whose host and port are replaced by the
+	// ones of the record's targets
+	Template *url.URL
+}
+
+// Resolve implements Resolver. The targets are ordered by priority, and then
+// by name so that the order is stable from one resolution to the next.
+func (s *SRV) Resolve(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", s.Record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %s", s.Record, err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Target < records[j].Target
+	})
+
+	urls := make([]string, 0, len(records))
+	for _, r := range records {
+		urls = append(urls, withHost(s.Template, strings.TrimSuffix(r.Target, "."), int(r.Port)))
+	}
+	return urls, nil
+}
+
+// withHost returns the template URL with the given host and port
+func withHost(template *url.URL, host string, port int) string {
+	u := *template
+	u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	return u.String()
+}
@@ -0,0 +1,20 @@
+// Package secret reads credentials from files, e.g. mounted Kubernetes or
+// Docker Swarm secrets
+package secret
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Read returns the content of the secret file without surrounding
+// whitespace. Callers read it at use time so that rotated secrets are picked
+// up without a restart.
+func Read(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %s", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
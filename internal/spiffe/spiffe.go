@@ -0,0 +1,302 @@
+// Package spiffe obtains the client certificate from a SPIFFE Workload API,
+// e.g. a SPIRE agent, which pushes the rotated X.509 SVIDs
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// retryInterval is the delay before reconnecting to the Workload API after
+// the stream of SVIDs broke
+const retryInterval = 5 * time.Second
+
+// fetchX509SVID is the gRPC method streaming the X.509 SVIDs
+const fetchX509SVID = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// Source keeps credentials up to date with the X.509 SVIDs of the Workload
+// API
+type Source struct {
+	// serverID is the SPIFFE ID expected from the servers, any ID of the
+	// trust domain being accepted when empty
+	serverID string
+	creds    *tlsconfig.Credentials
+	client   *http.Client
+}
+
+// NewSource creates a source of the Workload API at address, given as
+// unix:///path/to/socket or tcp://host:port. The credentials verify the
+// servers against the trust bundle of the SVIDs, and their SPIFFE ID against
+// serverID if set.
+func NewSource(address, serverID string, creds *tlsconfig.Credentials) (*Source, error) {
+	endpoint, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Workload API address: %v", err)
+	}
+
+	var network, addr string
+	switch endpoint.Scheme {
+	case "unix":
+		network, addr = "unix", endpoint.Path
+	case "tcp":
+		network, addr = "tcp", endpoint.Host
+	default:
+		return nil, fmt.Errorf("%s is not a valid Workload API scheme", endpoint.Scheme)
+	}
+
+	// gRPC requires HTTP/2, which the Workload API serves unencrypted
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+
+	s := &Source{
+		serverID: serverID,
+		creds:    creds,
+		client: &http.Client{Transport: &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}},
+	}
+	creds.VerifyPeer = s.verifyPeer
+	return s, nil
+}
+
+// Start streams the SVIDs into the credentials until ctx is done, and waits
+// for the first one at most timeout
+func (s *Source) Start(ctx context.Context, timeout time.Duration) error {
+	first := make(chan error, 1)
+	var once sync.Once
+	notify := func(err error) (notified bool) {
+		once.Do(func() {
+			first <- err
+			notified = true
+		})
+		return
+	}
+
+	go func() {
+		for {
+			err := s.stream(ctx, notify)
+			if ctx.Err() != nil {
+				return
+			}
+			if !notify(err) {
+				log.Errorf("failed to stream SVIDs from the Workload API: %s", err)
+			}
+			time.Sleep(retryInterval)
+		}
+	}()
+
+	select {
+	case err := <-first:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no SVID received from the Workload API within %s", timeout)
+	}
+}
+
+// stream reads SVIDs from the Workload API until the stream breaks. Updates
+// are passed to notify, which reports whether it was the first one.
+func (s *Source) stream(ctx context.Context, notify func(error) bool) error {
+	// An empty X509SVIDRequest in a gRPC frame
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost"+fetchX509SVID, bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Workload API: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to call Workload API: %s", resp.Status)
+	}
+
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(resp.Body, header); err != nil {
+			if err == io.EOF {
+				return grpcError(resp)
+			}
+			return fmt.Errorf("failed to read Workload API response: %s", err)
+		}
+		if header[0] != 0 {
+			return fmt.Errorf("compressed Workload API responses are not supported")
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			return fmt.Errorf("failed to read Workload API response: %s", err)
+		}
+
+		if err := s.update(msg); err != nil {
+			return err
+		}
+		if !notify(nil) {
+			log.Info("rotated SVID from the Workload API")
+		}
+	}
+}
+
+// grpcError returns the error of a gRPC stream which ended, carried by its
+// trailers or by its headers when it ended without a message
+func grpcError(resp *http.Response) error {
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status == "" || status == "0" {
+		return fmt.Errorf("the Workload API stream ended")
+	}
+	message, _ = url.PathUnescape(message)
+	return fmt.Errorf("the Workload API returned status %s: %s", status, message)
+}
+
+// update sets the credentials from the default, i.e. first, SVID of a
+// X509SVIDResponse
+func (s *Source) update(msg []byte) error {
+	var svid []byte
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.BytesType && svid == nil {
+			v, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			svid, msg = v, msg[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	if svid == nil {
+		return fmt.Errorf("no SVID in Workload API response")
+	}
+
+	// X509SVID fields: 2 is the DER certificate chain, 3 the PKCS#8 key and
+	// 4 the DER trust bundle
+	fields := map[protowire.Number][]byte{}
+	for len(svid) > 0 {
+		num, typ, n := protowire.ConsumeTag(svid)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		svid = svid[n:]
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(svid)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fields[num], svid = v, svid[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, svid)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		svid = svid[n:]
+	}
+
+	certPEM, err := certificatesPEM(fields[2])
+	if err != nil {
+		return err
+	}
+	bundlePEM, err := certificatesPEM(fields[4])
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: fields[3]})
+	return s.creds.Set(certPEM, keyPEM, bundlePEM)
+}
+
+// certificatesPEM converts concatenated DER certificates to PEM
+func certificatesPEM(der []byte) ([]byte, error) {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SVID certificates: %s", err)
+	}
+
+	var b bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return b.Bytes(), nil
+}
+
+// verifyPeer verifies the certificate of a server against the current trust
+// bundle, the way SPIFFE peers do, i.e. by SPIFFE ID instead of host name
+func (s *Source) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(s.creds.CACert()) {
+		return fmt.Errorf("no trust bundle")
+	}
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %s", err)
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return err
+	}
+
+	if s.serverID == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(leaf.URIs))
+	for _, u := range leaf.URIs {
+		ids = append(ids, u.String())
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("server certificate without SPIFFE ID, expected %s", s.serverID)
+	}
+	if !slices.Contains(ids, s.serverID) {
+		return fmt.Errorf("unexpected server SPIFFE ID %s, expected %s", strings.Join(ids, ", "), s.serverID)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// svid is an X.509 SVID along with the CA certificate it is signed by
+type svid struct {
+	ca, cert *x509.Certificate
+	key      *ecdsa.PrivateKey
+}
+
+// newSVID issues an SVID of the SPIFFE ID, and its CA certificate
+func newSVID(t *testing.T, id string) svid {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svid{ca: ca, cert: cert, key: key}
+}
+
+// response returns the X509SVIDResponse holding the SVIDs, preceded by an
+// unknown field
+func response(t *testing.T, svids ...svid) []byte {
+	t.Helper()
+
+	msg := protowire.AppendTag(nil, 99, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, 1)
+	for _, s := range svids {
+		key, err := x509.MarshalPKCS8PrivateKey(s.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m []byte
+		m = protowire.AppendTag(m, 1, protowire.BytesType)
+		m = protowire.AppendString(m, s.cert.URIs[0].String())
+		m = protowire.AppendTag(m, 2, protowire.BytesType)
+		m = protowire.AppendBytes(m, s.cert.Raw)
+		m = protowire.AppendTag(m, 3, protowire.BytesType)
+		m = protowire.AppendBytes(m, key)
+		m = protowire.AppendTag(m, 4, protowire.BytesType)
+		m = protowire.AppendBytes(m, s.ca.Raw)
+
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, m)
+	}
+	return msg
+}
+
+// frame returns the gRPC frame of the message
+func frame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// newWorkloadAPI starts a Workload API answering with the gRPC stream written
+// by handle, and returns a source of it
+func newWorkloadAPI(t *testing.T, handle func(w http.ResponseWriter)) (*Source, *tlsconfig.Credentials) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Protocols: protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != fetchX509SVID || r.Header.Get("workload.spiffe.io") != "true" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+			w.WriteHeader(http.StatusOK)
+			handle(w)
+		}),
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	creds := &tlsconfig.Credentials{}
+	s, err := NewSource("tcp://"+l.Addr().String(), "spiffe://example.org/puppetdb", creds)
+	if err != nil {
+		t.Fatalf("failed to create source: %s", err)
+	}
+	return s, creds
+}
+
+// write writes the parts of the stream, flushing each of them
+func write(w http.ResponseWriter, parts ...[]byte) {
+	for _, part := range parts {
+		w.Write(part)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// stream streams the SVIDs of the source and returns the error which ended
+// the stream along with the count of SVIDs received
+func stream(s *Source) (updates int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = s.stream(ctx, func(error) bool {
+		updates++
+		return updates == 1
+	})
+	return
+}
+
+func TestStream(t *testing.T) {
+	current, other := newSVID(t, "spiffe://example.org/exporter"), newSVID(t, "spiffe://example.org/other")
+	msg := frame(response(t, current, other))
+	s, creds := newWorkloadAPI(t, func(w http.ResponseWriter) {
+		// The length prefix and the message are split across writes
+		write(w, msg[:3], msg[3:20], msg[20:])
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	updates, err := stream(s)
+	if err == nil || !strings.Contains(err.Error(), "stream ended") {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+	if updates != 1 {
+		t.Fatalf("got %d SVIDs, want 1", updates)
+	}
+
+	// The first SVID is the default one
+	cert, err := creds.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to get client certificate: %s", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], current.cert.Raw) {
+		t.Error("the client certificate is not the one of the first SVID")
+	}
+	if key, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok || !key.Equal(current.key) {
+		t.Error("the client key is not the one of the first SVID")
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: current.ca.Raw})
+	if !bytes.Equal(creds.CACert(), bundle) {
+		t.Error("the trust bundle is not the one of the first SVID")
+	}
+
+	// The servers are verified against the bundle and the server ID
+	server := newSVID(t, "spiffe://example.org/puppetdb")
+	if err := s.verifyPeer([][]byte{server.cert.Raw}, nil); err == nil {
+		t.Error("expected a server of another trust bundle to be rejected")
+	}
+	if err := s.verifyPeer([][]byte{current.cert.Raw}, nil); err == nil || !strings.Contains(err.Error(), "unexpected server SPIFFE ID") {
+		t.Errorf("expected a server of another SPIFFE ID to be rejected, got %v", err)
+	}
+}
+
+func TestStreamRotation(t *testing.T) {
+	first, second := newSVID(t, "spiffe://example.org/exporter"), newSVID(t, "spiffe://example.org/exporter")
+	s, creds := newWorkloadAPI(t, func(w http.ResponseWriter) {
+		// Both messages are sent at once
+		write(w, append(frame(response(t, first)), frame(response(t, second))...))
+	})
+
+	if updates, _ := stream(s); updates != 2 {
+		t.Fatalf("got %d SVIDs, want 2", updates)
+	}
+	cert, err := creds.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to get client certificate: %s", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], second.cert.Raw) {
+		t.Error("the client certificate is not the one of the latest SVID")
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	current := newSVID(t, "spiffe://example.org/exporter")
+	msg := response(t, current)
+
+	for _, tc := range []struct {
+		name   string
+		handle func(w http.ResponseWriter)
+		want   string
+	}{
+		{
+			name: "status trailer",
+			handle: func(w http.ResponseWriter) {
+				w.Header().Set("Grpc-Status", "7")
+				w.Header().Set("Grpc-Message", "no%20identity%20issued")
+			},
+			want: "the Workload API returned status 7: no identity issued",
+		},
+		{
+			name: "status after message",
+			handle: func(w http.ResponseWriter) {
+				write(w, frame(msg))
+				w.Header().Set("Grpc-Status", "14")
+				w.Header().Set("Grpc-Message", "agent%20shutting%20down")
+			},
+			want: "the Workload API returned status 14: agent shutting down",
+		},
+		{
+			name:   "empty message",
+			handle: func(w http.ResponseWriter) { write(w, frame(nil)) },
+			want:   "no SVID in Workload API response",
+		},
+		{
+			name:   "truncated length prefix",
+			handle: func(w http.ResponseWriter) { write(w, frame(msg)[:3]) },
+			want:   "failed to read Workload API response",
+		},
+		{
+			name:   "truncated message",
+			handle: func(w http.ResponseWriter) { write(w, frame(msg)[:len(msg)]) },
+			want:   "failed to read Workload API response",
+		},
+		{
+			name: "compressed message",
+			handle: func(w http.ResponseWriter) {
+				b := frame(msg)
+				b[0] = 1
+				write(w, b)
+			},
+			want: "compressed Workload API responses are not supported",
+		},
+		{
+			name:   "invalid message",
+			handle: func(w http.ResponseWriter) { write(w, frame([]byte{0x0a, 0x05, 0x01})) },
+			want:   "unexpected EOF",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newWorkloadAPI(t, tc.handle)
+			_, err := stream(s)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
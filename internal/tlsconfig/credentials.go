@@ -0,0 +1,53 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+)
+
+// Credentials hold a client certificate and a CA certificate in memory, e.g.
+// fetched from Vault, which can be replaced when they are renewed
+type Credentials struct {
+	// VerifyPeer replaces the verification of the servers against the CA
+	// certificate when set, e.g. to verify SPIFFE IDs instead of host names
+	VerifyPeer func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	caCert []byte
+}
+
+// Set replaces the PEM encoded client certificate, key and CA certificate.
+// The CA certificate only applies to the clients created afterwards.
+func (c *Credentials) Set(certPEM, keyPEM, caCertPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load keypair: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.caCert = caCertPEM
+	return nil
+}
+
+// GetClientCertificate returns the current client certificate, it is meant
+// as tls.Config.GetClientCertificate
+func (c *Credentials) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	return c.cert, nil
+}
+
+// CACert returns the current PEM encoded CA certificate, if any
+func (c *Credentials) CACert() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caCert
+}
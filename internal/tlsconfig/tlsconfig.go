@@ -0,0 +1,98 @@
+// Package tlsconfig loads the certificates used to connect to the Puppet services
+package tlsconfig
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Files locates the PEM encoded client certificate, key and CA certificate
+type Files struct {
+	CertPath   string
+	KeyPath    string
+	CACertPath string
+	// CAAppendSystem adds the CA certificate to the system trust store
+	// instead of trusting it alone
+	CAAppendSystem     bool
+	InsecureSkipVerify bool
+	// Credentials replace CertPath and KeyPath when set, and CACertPath
+	// when it is empty and they hold a CA certificate
+	Credentials *Credentials
+}
+
+// Load returns a TLS configuration authenticating with the client certificate
+// and trusting the CA certificate
+func Load(files *Files) (*tls.Config, error) {
+	if files.Credentials != nil {
+		config, err := LoadCA(files)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = files.Credentials.GetClientCertificate
+		return config, nil
+	}
+
+	// Load client cert
+	cert, err := tls.LoadX509KeyPair(files.CertPath, files.KeyPath)
+	if err != nil {
+		err = fmt.Errorf("failed to load keypair: %s", err)
+		return nil, err
+	}
+
+	config, err := LoadCA(files)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// LoadCA returns a TLS configuration trusting the CA certificate, without a
+// client certificate. The system trust store is used when CACertPath is empty.
+func LoadCA(files *Files) (*tls.Config, error) {
+	if files.CACertPath == "" && files.Credentials != nil && files.Credentials.VerifyPeer != nil {
+		// The standard verification is replaced, not skipped
+		return &tls.Config{
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: files.Credentials.VerifyPeer,
+		}, nil
+	}
+
+	var caCert []byte
+	if files.CACertPath == "" && files.Credentials != nil {
+		caCert = files.Credentials.CACert()
+	}
+	if files.CACertPath == "" && caCert == nil {
+		return &tls.Config{InsecureSkipVerify: files.InsecureSkipVerify}, nil
+	}
+
+	// Load CA cert
+	var err error
+	if caCert == nil {
+		caCert, err = os.ReadFile(files.CACertPath)
+		if err != nil {
+			err = fmt.Errorf("failed to load ca certificate: %s", err)
+			return nil, err
+		}
+	}
+	caCertPool := x509.NewCertPool()
+	if files.CAAppendSystem {
+		caCertPool, err = x509.SystemCertPool()
+		if err != nil {
+			err = fmt.Errorf("failed to load system certificate pool: %s", err)
+			return nil, err
+		}
+	}
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		err = fmt.Errorf("failed to parse ca certificate %s", cmp.Or(files.CACertPath, "of the credentials"))
+		return nil, err
+	}
+
+	return &tls.Config{
+		RootCAs:            caCertPool,
+		InsecureSkipVerify: files.InsecureSkipVerify,
+	}, nil
+}
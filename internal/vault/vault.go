@@ -0,0 +1,199 @@
+// Package vault fetches the client certificate used to connect to the Puppet
+// services from HashiCorp Vault, so that it never lands on disk
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/secret"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// retryInterval is the delay before fetching the credentials again after a
+// failed renewal
+const retryInterval = time.Minute
+
+// Client fetches credentials from Vault
+type Client struct {
+	options *Options
+	client  *http.Client
+}
+
+// Options contains the options used to fetch credentials from Vault
+type Options struct {
+	// Address is the Vault address, e.g. https://vault:8200
+	Address string
+	// Token authenticates to Vault, TokenPath locates a file holding it
+	// instead, read for every request
+	Token      string
+	TokenPath  string
+	CACertPath string
+	SSLVerify  bool
+	// PKIPath is the issue endpoint of a PKI secrets engine, e.g.
+	// pki/issue/puppetdb-exporter, which issues a certificate for
+	// CommonName valid for TTL, the role's default when empty
+	PKIPath    string
+	CommonName string
+	TTL        string
+	// KVPath is a KV secret holding the certificate, private_key and ca
+	// keys, e.g. secret/data/puppetdb-exporter for a KV version 2 engine,
+	// read again every KVRefresh
+	KVPath    string
+	KVRefresh time.Duration
+	Timeout   time.Duration
+}
+
+// NewClient creates a new Vault client
+func NewClient(options *Options) (*Client, error) {
+	if (options.PKIPath == "") == (options.KVPath == "") {
+		return nil, fmt.Errorf("exactly one of the PKI and KV paths is required")
+	}
+
+	tlsConfig, err := tlsconfig.LoadCA(&tlsconfig.Files{
+		CACertPath:         options.CACertPath,
+		InsecureSkipVerify: !options.SSLVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		options: options,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   options.Timeout,
+		},
+	}, nil
+}
+
+// Fetch fetches the credentials into creds and returns the time they should
+// be fetched again
+func (c *Client) Fetch(ctx context.Context, creds *tlsconfig.Credentials) (time.Time, error) {
+	var data struct {
+		// PKI issue response
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+		Expiration  int64    `json:"expiration"`
+		// KV response, the secret being nested in data by version 2
+		CA   string          `json:"ca"`
+		Data json.RawMessage `json:"data"`
+	}
+
+	var err error
+	if c.options.PKIPath != "" {
+		body := map[string]string{"common_name": c.options.CommonName}
+		if c.options.TTL != "" {
+			body["ttl"] = c.options.TTL
+		}
+		err = c.call(ctx, http.MethodPost, c.options.PKIPath, body, &data)
+	} else {
+		err = c.call(ctx, http.MethodGet, c.options.KVPath, nil, &data)
+		if err == nil && len(data.Data) > 0 {
+			err = json.Unmarshal(data.Data, &data)
+		}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if data.Certificate == "" || data.PrivateKey == "" {
+		return time.Time{}, fmt.Errorf("no certificate and private key in Vault response")
+	}
+
+	ca := data.CA
+	if ca == "" {
+		ca = strings.Join(append([]string{data.IssuingCA}, data.CAChain...), "\n")
+	}
+	var caCert []byte
+	if strings.TrimSpace(ca) != "" {
+		caCert = []byte(ca)
+	}
+	if err := creds.Set([]byte(data.Certificate), []byte(data.PrivateKey), caCert); err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	if data.Expiration > 0 {
+		// Renew once two thirds of the lifetime elapsed
+		return now.Add(time.Until(time.Unix(data.Expiration, 0)) * 2 / 3), nil
+	}
+	return now.Add(c.options.KVRefresh), nil
+}
+
+// Renew fetches the credentials again whenever they are due, until ctx is
+// done. Failed renewals are retried while the current credentials are kept.
+func (c *Client) Renew(ctx context.Context, creds *tlsconfig.Credentials, next time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		var err error
+		if next, err = c.Fetch(ctx, creds); err != nil {
+			log.Errorf("failed to renew credentials from Vault: %s", err)
+			next = time.Now().Add(retryInterval)
+			continue
+		}
+		log.Infof("renewed credentials from Vault, next renewal at %s", next.Format(time.RFC3339))
+	}
+}
+
+// call calls the Vault API and decodes the data of its response into object
+func (c *Client) call(ctx context.Context, method, path string, body interface{}, object interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	myurl := fmt.Sprintf("%s/v1/%s", strings.TrimRight(c.options.Address, "/"), strings.TrimLeft(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, method, myurl, reqBody)
+	if err != nil {
+		return err
+	}
+
+	token := c.options.Token
+	if c.options.TokenPath != "" {
+		if token, err = secret.Read(c.options.TokenPath); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Vault: %s", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read Vault response: %s", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to call Vault: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &response); err != nil {
+		return fmt.Errorf("failed to unmarshal Vault response: %s", err)
+	}
+	return json.Unmarshal(response.Data, object)
+}
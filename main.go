@@ -2,34 +2,204 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
+	// The location of timestamps is loaded from the embedded time zone
+	// database in images without one
+	_ "time/tzdata"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/iobear/prometheus-puppetdb-exporter/internal/exporter"
+	"github.com/iobear/prometheus-puppetdb-exporter/exporter"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/classifier"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/leader"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/puppetserver"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/remotewrite"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/resolver"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/secret"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/spiffe"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/systemd"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/vault"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb/puppetdbtest"
 )
 
+// categoriesAuto is the --categories value discovering the categories
+const categoriesAuto = "auto"
+
 // Config stores handler's configuration
 type Config struct {
-	Version        bool   `long:"version" description:"Show version."`
-	PuppetDBUrl    string `short:"u" long:"puppetdb-url" description:"PuppetDB base URL." env:"PUPPETDB_URL" required:"true" default:"https://puppetdb:8081/pdb/query"`
-	CertFile       string `long:"cert-file" description:"A PEM encoded certificate file." env:"PUPPETDB_CERT_FILE"`
-	KeyFile        string `long:"key-file" description:"A PEM encoded private key file." env:"PUPPETDB_KEY_FILE"`
-	CACertFile     string `long:"ca-file" description:"A PEM encoded CA's certificate." env:"PUPPETDB_CA_FILE"`
-	SSLSkipVerify  bool   `long:"ssl-skip-verify" description:"Skip SSL verification." env:"PUPPETDB_SSL_SKIP_VERIFY"`
-	ScrapeInterval string `long:"scrape-interval" description:"Duration between two scrapes." env:"PUPPETDB_SCRAPE_INTERVAL" default:"5s"`
-	ListenAddress  string `long:"listen-address" description:"Address to listen on for web interface and telemetry." env:"PUPPETDB_LISTEN_ADDRESS" default:"0.0.0.0:9635"`
-	MetricPath     string `long:"metric-path" description:"Path under which to expose metrics." env:"PUPPETDB_METRIC_PATH" default:"/metrics"`
-	Verbose        bool   `long:"verbose" description:"Enable debug mode" env:"PUPPETDB_VERBOSE"`
-	UnreportedNode string `long:"unreported-node" description:"Tag nodes as unreported if the latest report is older than the defined duration." env:"PUPPETDB_UNREPORTED_NODE" default:"2h"`
-	Categories     string `long:"categories" description:"Report metrics categories to scrape." env:"REPORT_METRICS_CATEGORIES" default:"resources,time,changes,events"`
+	Version        bool              `long:"version" description:"Show version."`
+	PuppetDBUrl    string            `short:"u" long:"puppetdb-url" description:"PuppetDB base URL. Use unix:///path/to/puppetdb.sock/pdb/query to connect through a Unix domain socket." env:"PUPPETDB_URL" required:"true" default:"https://puppetdb:8081/pdb/query"`
+	CertFile       string            `long:"cert-file" description:"A PEM encoded certificate file." env:"PUPPETDB_CERT_FILE"`
+	KeyFile        string            `long:"key-file" description:"A PEM encoded private key file." env:"PUPPETDB_KEY_FILE"`
+	CACertFile     string            `long:"ca-file" description:"A PEM encoded CA's certificate." env:"PUPPETDB_CA_FILE"`
+	SSLSkipVerify  bool              `long:"ssl-skip-verify" description:"Skip SSL verification." env:"PUPPETDB_SSL_SKIP_VERIFY"`
+	CAAppendSystem bool              `long:"ca-append-system" description:"Trust the CA's certificate in addition to the system trust store." env:"PUPPETDB_CA_APPEND_SYSTEM"`
+	SPIFFESocket   string            `long:"spiffe.endpoint-socket" description:"Address of a SPIFFE Workload API, e.g. unix:///run/spire/agent.sock, whose rotated X.509 SVIDs replace --cert-file and --key-file. Servers are verified against the SVIDs' trust bundle unless --ca-file is set." env:"PUPPETDB_SPIFFE_ENDPOINT_SOCKET"`
+	SPIFFEServerID string            `long:"spiffe.server-id" description:"SPIFFE ID expected from the servers verified against the trust bundle, e.g. spiffe://example.org/puppetdb. (default: any ID of the trust domain)" env:"PUPPETDB_SPIFFE_SERVER_ID"`
+	VaultAddress   string            `long:"vault.address" description:"Vault address, e.g. https://vault:8200, from which the client certificate replacing --cert-file and --key-file is fetched, and renewed, with --vault.pki-path or --vault.kv-path." env:"PUPPETDB_VAULT_ADDRESS"`
+	VaultToken     string            `long:"vault.token" description:"Vault token." env:"PUPPETDB_VAULT_TOKEN"`
+	VaultTokenFile string            `long:"vault.token-file" description:"File holding the Vault token, read for every request." env:"PUPPETDB_VAULT_TOKEN_FILE"`
+	VaultCAFile    string            `long:"vault.ca-file" description:"A PEM encoded CA's certificate for Vault. (default: system trust store)" env:"PUPPETDB_VAULT_CA_FILE"`
+	VaultSkipVerif bool              `long:"vault.ssl-skip-verify" description:"Skip SSL verification of Vault." env:"PUPPETDB_VAULT_SSL_SKIP_VERIFY"`
+	VaultPKIPath   string            `long:"vault.pki-path" description:"Issue endpoint of a Vault PKI secrets engine, e.g. pki/issue/puppetdb-exporter, issuing the client certificate. It is renewed once two thirds of its lifetime elapsed." env:"PUPPETDB_VAULT_PKI_PATH"`
+	VaultCN        string            `long:"vault.common-name" description:"Common name of the certificate issued by --vault.pki-path. (default: the host name)" env:"PUPPETDB_VAULT_COMMON_NAME"`
+	VaultTTL       string            `long:"vault.ttl" description:"Lifetime of the certificate issued by --vault.pki-path. (default: the role's one)" env:"PUPPETDB_VAULT_TTL"`
+	VaultKVPath    string            `long:"vault.kv-path" description:"Vault KV secret holding the certificate, private_key and optional ca keys, e.g. secret/data/puppetdb-exporter." env:"PUPPETDB_VAULT_KV_PATH"`
+	VaultKVRefresh string            `long:"vault.kv-refresh-interval" description:"Interval between two reads of --vault.kv-path." env:"PUPPETDB_VAULT_KV_REFRESH_INTERVAL" default:"1h"`
+	NodeQuery      string            `long:"puppetdb.node-query" description:"AST query ANDed into the nodes query to restrict the exported nodes, e.g. [\"=\", \"report_environment\", \"production\"]." env:"PUPPETDB_NODE_QUERY"`
+	Environments   []string          `long:"filter.environments" description:"Only export nodes of the given report environments." env:"PUPPETDB_FILTER_ENVIRONMENTS" env-delim:","`
+	ExcludeEnvs    []string          `long:"filter.exclude-environments" description:"Do not export nodes of the given report environments." env:"PUPPETDB_FILTER_EXCLUDE_ENVIRONMENTS" env-delim:","`
+	CertnameIncl   string            `long:"filter.certname-include" description:"Only export nodes whose certname matches this anchored regular expression." env:"PUPPETDB_FILTER_CERTNAME_INCLUDE"`
+	CertnameExcl   string            `long:"filter.certname-exclude" description:"Do not export nodes whose certname matches this anchored regular expression." env:"PUPPETDB_FILTER_CERTNAME_EXCLUDE"`
+	LockFile       string            `long:"ha.lock-file" description:"Lock file shared by several instances, of which only the one holding the lock scrapes PuppetDB while the other ones stand by." env:"PUPPETDB_HA_LOCK_FILE"`
+	ShardIndex     int               `long:"shard.index" description:"Index of the shard of nodes exported by this instance, from 0 to --shard.total - 1." env:"PUPPETDB_SHARD_INDEX" default:"0"`
+	ShardTotal     int               `long:"shard.total" description:"Number of instances the nodes are split across by a hash of their certname." env:"PUPPETDB_SHARD_TOTAL" default:"1"`
+	ExclInactive   bool              `long:"filter.exclude-inactive" description:"Do not export per-node metrics of deactivated and expired nodes." env:"PUPPETDB_FILTER_EXCLUDE_INACTIVE"`
+	ExclInactiveCt bool              `long:"filter.exclude-inactive-counts" description:"Do not count deactivated and expired nodes in the status counts." env:"PUPPETDB_FILTER_EXCLUDE_INACTIVE_COUNTS"`
+	Origin         string            `long:"puppetdb.origin" description:"Origin reported to PuppetDB with every query. (default: prometheus-puppetdb-exporter/<version>)" env:"PUPPETDB_ORIGIN"`
+	PageSize       int               `long:"puppetdb.page-size" description:"Fetch the nodes in pages of as many nodes rather than in a single query, unless 0." env:"PUPPETDB_PAGE_SIZE" default:"0"`
+	PageConc       int               `long:"puppetdb.page-concurrency" description:"Number of node pages fetched concurrently." env:"PUPPETDB_PAGE_CONCURRENCY" default:"4"`
+	Conditional    bool              `long:"puppetdb.conditional-requests" description:"Revalidate the previous responses of the nodes and facts queries with their ETag or Last-Modified validators, e.g. through a caching proxy." env:"PUPPETDB_CONDITIONAL_REQUESTS"`
+	SRVRecord      string            `long:"puppetdb.srv-record" description:"DNS SRV record resolved before each scrape into the PuppetDB servers, e.g. _puppetdb._tcp.example.com. Their host and port replace the ones of --puppetdb-url." env:"PUPPETDB_SRV_RECORD"`
+	ConsulService  string            `long:"consul.service" description:"Consul service whose healthy instances are the PuppetDB servers, resolved before each scrape. Their address and port replace the ones of --puppetdb-url." env:"PUPPETDB_CONSUL_SERVICE"`
+	ConsulAddress  string            `long:"consul.address" description:"Address of the Consul HTTP API." env:"PUPPETDB_CONSUL_ADDRESS" default:"http://127.0.0.1:8500"`
+	ConsulTag      string            `long:"consul.tag" description:"Tag restricting the instances of the Consul service." env:"PUPPETDB_CONSUL_TAG"`
+	ConsulDC       string            `long:"consul.datacenter" description:"Datacenter of the Consul service. (default: the agent's one)" env:"PUPPETDB_CONSUL_DATACENTER"`
+	ConsulToken    string            `long:"consul.token" description:"ACL token of the Consul HTTP API." env:"PUPPETDB_CONSUL_TOKEN"`
+	ConsulTokenF   string            `long:"consul.token-file" description:"File holding the ACL token of the Consul HTTP API, read for every request." env:"PUPPETDB_CONSUL_TOKEN_FILE"`
+	ConsulCertFile string            `long:"consul.cert-file" description:"A PEM encoded client certificate file for the Consul HTTP API." env:"PUPPETDB_CONSUL_CERT_FILE"`
+	ConsulKeyFile  string            `long:"consul.key-file" description:"A PEM encoded client private key file for the Consul HTTP API." env:"PUPPETDB_CONSUL_KEY_FILE"`
+	ConsulCAFile   string            `long:"consul.ca-file" description:"A PEM encoded CA's certificate for the Consul HTTP API. (default: system trust store)" env:"PUPPETDB_CONSUL_CA_FILE"`
+	ConsulSkipVer  bool              `long:"consul.ssl-skip-verify" description:"Skip SSL verification of the Consul HTTP API." env:"PUPPETDB_CONSUL_SSL_SKIP_VERIFY"`
+	K8sService     string            `long:"kubernetes.service" description:"Kubernetes service, given as namespace/name or as a name in the exporter's namespace, whose ready endpoints are the PuppetDB servers, resolved before each scrape. Requires running in the cluster." env:"PUPPETDB_KUBERNETES_SERVICE"`
+	K8sPortName    string            `long:"kubernetes.port-name" description:"Name of the port of the Kubernetes service endpoints. (default: the first port)" env:"PUPPETDB_KUBERNETES_PORT_NAME"`
+	ReplicaURLs    []string          `long:"pe.replica-url" description:"URL of a PE replica's PuppetDB, queried when the primary is not running. Repeat in failover priority order." env:"PUPPETDB_PE_REPLICA_URL" env-delim:","`
+	QueryTimeouts  map[string]string `long:"query-timeout" description:"Timeout of a query type given as type:duration, where type is nodes, reports, facts, query, status or default. Repeat for several query types." env:"PUPPETDB_QUERY_TIMEOUT" env-delim:","`
+	ScrapeInterval string            `long:"scrape-interval" description:"Duration between two scrapes." env:"PUPPETDB_SCRAPE_INTERVAL" default:"5s"`
+	ScrapeTimeout  string            `long:"scrape.timeout" description:"Timeout of a whole scrape, after which it is aborted and the metrics of the previous scrape kept. Unbounded when 0." env:"PUPPETDB_SCRAPE_TIMEOUT" default:"0"`
+	Splay          string            `long:"scrape.splay" description:"Window within which the start of each scrape is randomly delayed, so that several instances do not query PuppetDB at once." env:"PUPPETDB_SCRAPE_SPLAY" default:"0"`
+	FullRefresh    string            `long:"scrape.full-refresh-interval" description:"Interval between two fetches of every node, in between only the nodes which changed since the previous scrape are fetched. Every node is fetched each scrape when 0." env:"PUPPETDB_SCRAPE_FULL_REFRESH_INTERVAL" default:"0"`
+	Overlap        string            `long:"scrape.incremental-overlap" description:"Margin by which the nodes fetched between full refreshes go back before the previous scrape. The nodes are selected by the time their commands were produced, so updates delayed by more than the margin, by the command queue or clock skew, are missed until the next full refresh; a larger margin fetches more nodes each scrape." env:"PUPPETDB_SCRAPE_INCREMENTAL_OVERLAP" default:"10m"`
+	AutoTune       bool              `long:"scrape.auto-tune" description:"Stretch the scrape interval when scrape cycles consistently take too long." env:"PUPPETDB_SCRAPE_AUTO_TUNE"`
+	AutoTuneFrac   float64           `long:"scrape.auto-tune-fraction" description:"Fraction of the scrape interval a scrape cycle may take before the interval is stretched." env:"PUPPETDB_SCRAPE_AUTO_TUNE_FRACTION" default:"0.8"`
+	ListenAddress  []string          `long:"listen-address" description:"Address to listen on for web interface and telemetry. Repeat to listen on several addresses, e.g. an IPv4 and an IPv6 one." env:"PUPPETDB_LISTEN_ADDRESS" env-delim:"," default:"0.0.0.0:9635"`
+	MetricPath     string            `long:"metric-path" description:"Path under which to expose metrics." env:"PUPPETDB_METRIC_PATH" default:"/metrics"`
+	TelemetryPath  string            `long:"web.telemetry-path" description:"Alias of --metric-path, the name used by most exporters." env:"PUPPETDB_TELEMETRY_PATH"`
+	NoOpenMetrics  bool              `long:"web.disable-openmetrics" description:"Do not serve the metrics in the OpenMetrics format to scrapers which negotiate it." env:"PUPPETDB_WEB_DISABLE_OPENMETRICS"`
+	NoGoMetrics    bool              `long:"web.disable-go-collector" description:"Do not export the go_* metrics of the exporter's runtime." env:"PUPPETDB_WEB_DISABLE_GO_COLLECTOR"`
+	NoProcMetrics  bool              `long:"web.disable-process-collector" description:"Do not export the process_* metrics of the exporter's process." env:"PUPPETDB_WEB_DISABLE_PROCESS_COLLECTOR"`
+	Once           bool              `long:"once" description:"Scrape PuppetDB once, print the metrics to stdout and exit, with a non-zero status when the scrape failed." env:"PUPPETDB_ONCE"`
+	Mock           bool              `long:"mock" description:"Serve the metrics of simulated nodes instead of querying PuppetDB, e.g. to develop dashboards and alerting rules." env:"PUPPETDB_MOCK"`
+	MockNodes      int               `long:"mock.nodes" description:"Number of simulated nodes." env:"PUPPETDB_MOCK_NODES" default:"100"`
+	MockFailRate   float64           `long:"mock.failure-rate" description:"Fraction of the simulated Puppet runs which fail." env:"PUPPETDB_MOCK_FAILURE_RATE" default:"0.05"`
+	Verbose        bool              `long:"verbose" description:"Enable debug mode" env:"PUPPETDB_VERBOSE"`
+	TimeLayouts    []string          `long:"timestamp-layout" description:"Go time layout PuppetDB timestamps are parsed with when they are not RFC 3339, e.g. 2006-01-02 15:04:05 -0700. Repeat for several layouts." env:"PUPPETDB_TIMESTAMP_LAYOUT" env-delim:";"`
+	TimeLocation   string            `long:"timestamp-location" description:"Time zone of the timestamps parsed with a --timestamp-layout without time zone, e.g. Europe/Paris." env:"PUPPETDB_TIMESTAMP_LOCATION" default:"UTC"`
+	UnreportedNode string            `long:"unreported-node" description:"Tag nodes as unreported if the latest report is older than the defined duration." env:"PUPPETDB_UNREPORTED_NODE" default:"2h"`
+	Categories     string            `long:"categories" description:"Report metrics categories to scrape, auto adding every category found in the reports." env:"REPORT_METRICS_CATEGORIES" default:"resources,time,changes,events"`
+	CategoryMetric []string          `long:"categories.metric" description:"Report metric exported, given as category.name, e.g. time.total. The other metrics of its category are not exported. Repeat for several metrics." env:"REPORT_METRICS_CATEGORIES_METRIC" env-delim:","`
+	CategoryLabels []string          `long:"categories.label" description:"Label kept on the report metrics of the categories along with name and host, e.g. environment, the other ones being omitted. Repeat for several labels." env:"REPORT_METRICS_CATEGORIES_LABEL" env-delim:","`
+	ExclCategories []string          `long:"categories.exclude" description:"Report metrics category not exported by --categories=auto. Repeat for several categories." env:"REPORT_METRICS_CATEGORIES_EXCLUDE" env-delim:","`
+	HostLookup     string            `long:"host-label.lookup-file" description:"File of \"certname host\" lines mapping certnames to host label values." env:"PUPPETDB_HOST_LABEL_LOOKUP_FILE"`
+	HostRegex      string            `long:"host-label.regex" description:"Anchored regular expression rewriting matching certnames into the host label value." env:"PUPPETDB_HOST_LABEL_REGEX"`
+	HostReplace    string            `long:"host-label.replacement" description:"Replacement of certnames matching --host-label.regex, with $1 or ${name} referring to capture groups." env:"PUPPETDB_HOST_LABEL_REPLACEMENT" default:"$1"`
+	HostStripDom   bool              `long:"host-label.strip-domain" description:"Strip the domain of certnames in the host label." env:"PUPPETDB_HOST_LABEL_STRIP_DOMAIN"`
+	SilenceFact    string            `long:"facts.silence-fact" description:"Boolean fact set on nodes which opt out of status counts and per-node metrics." env:"PUPPETDB_FACTS_SILENCE_FACT"`
+	ThresholdFact  string            `long:"facts.unreported-threshold-fact" description:"Fact holding a node's own unreported duration, e.g. 7d." env:"PUPPETDB_FACTS_UNREPORTED_THRESHOLD_FACT"`
+	ThresholdOver  []string          `long:"facts.unreported-threshold-override" description:"Unreported duration of the nodes with a fact value, given as fact=value:duration, e.g. trusted.extensions.pp_role=laptop:7d. The first matching override applies. Repeat for several overrides." env:"PUPPETDB_FACTS_UNREPORTED_THRESHOLD_OVERRIDE" env-delim:";"`
+	FactMetrics    []string          `long:"facts.metrics" description:"Numeric fact exported as a puppet_fact_<name> gauge, dotted paths such as os.release.major select values in structured facts. Repeat for several facts." env:"PUPPETDB_FACTS_METRICS" env-delim:","`
+	FactLabels     []string          `long:"facts.labels" description:"Fact attached as a label to the per-node metrics, dotted paths such as trusted.extensions.pp_role select values in structured facts. Repeat for several facts." env:"PUPPETDB_FACTS_LABELS" env-delim:","`
+	SeriesAudit    bool              `long:"debug.series-audit" description:"Check the consistency of the exported series after each scrape and serve the result at /debug/series." env:"PUPPETDB_DEBUG_SERIES_AUDIT"`
+	ReportNames    string            `long:"metrics.report-metric-names" description:"Form of the name label of the report metrics: raw as found in the reports, e.g. config_retrieval, or title as in previous releases, e.g. Config retrieval." env:"PUPPETDB_METRICS_REPORT_METRIC_NAMES" choice:"raw" choice:"title" default:"raw"`
+	CatalogRes     []string          `long:"collector.catalog-resource" description:"Resource whose active nodes are counted, given as a reference such as Class[Profile::Base] or a type such as Service. Repeat for several resources." env:"PUPPETDB_COLLECTOR_CATALOG_RESOURCE" env-delim:";"`
+	QueriesFile    string            `long:"queries.file" description:"JSON file of user-defined PuppetDB queries exported as gauges." env:"PUPPETDB_QUERIES_FILE"`
+	Namespace      string            `long:"metrics.namespace" description:"Prefix of the namespaces of the metrics, e.g. site turns puppet_report into site_puppet_report." env:"PUPPETDB_METRICS_NAMESPACE"`
+	AggregateOnly  bool              `long:"metrics.aggregate-only" description:"Do not export per-host metrics, only the counts and sums across nodes." env:"PUPPETDB_METRICS_AGGREGATE_ONLY"`
+	DropLabels     []string          `long:"metrics.drop-label" description:"Label removed from the metrics, e.g. reason. The series left with the same labels are summed. Repeat for several labels." env:"PUPPETDB_METRICS_DROP_LABEL" env-delim:","`
+	RenameLabels   map[string]string `long:"metrics.rename-label" description:"Label renamed in the metrics, given as label:name, e.g. host:instance. Repeat for several labels." env:"PUPPETDB_METRICS_RENAME_LABEL" env-delim:","`
+	MaxSeries      int               `long:"metrics.max-series" description:"Maximum number of series, over which the per-host metrics are dropped and only the aggregates exported. Unbounded when 0." env:"PUPPETDB_METRICS_MAX_SERIES" default:"0"`
+	MaxSeriesPerMt int               `long:"metrics.max-series-per-metric" description:"Maximum number of series of a per-host metric, over which the per-host metrics are dropped. Unbounded when 0." env:"PUPPETDB_METRICS_MAX_SERIES_PER_METRIC" default:"0"`
+	ProblemNodes   bool              `long:"metrics.problem-nodes-only" description:"Only export report metrics of failed, changed and unreported nodes." env:"PUPPETDB_METRICS_PROBLEM_NODES_ONLY"`
+	Status         bool              `long:"collector.status" description:"Export the state, database status and queue depth of the PuppetDB service from its status API." env:"PUPPETDB_COLLECTOR_STATUS"`
+	Commands       bool              `long:"collector.commands" description:"Export the command queue depth and the number of processed, retried, discarded and fatal commands." env:"PUPPETDB_COLLECTOR_COMMANDS"`
+	Population     bool              `long:"collector.population" description:"Export the numbers of nodes and resources, and the resource duplication, stored in PuppetDB." env:"PUPPETDB_COLLECTOR_POPULATION"`
+	JMX            bool              `long:"collector.jmx" description:"Export the MBeans of the PuppetDB metrics API as puppetdb_jmx_* metrics." env:"PUPPETDB_COLLECTOR_JMX"`
+	JMXMBeans      []string          `long:"collector.jmx-mbean" description:"Object name pattern of the MBeans exported by --collector.jmx. Repeat for several patterns." env:"PUPPETDB_COLLECTOR_JMX_MBEAN" env-delim:";" default:"puppetlabs.puppetdb.mq:name=*" default:"puppetlabs.puppetdb.storage:name=*" default:"puppetlabs.puppetdb.database:name=*" default:"java.lang:type=Memory,*"`
+	PuppetServer   string            `long:"puppetserver.url" description:"Base URL of a Puppet Server whose status API is exported, e.g. https://puppet:8140." env:"PUPPETDB_PUPPETSERVER_URL"`
+	PSCertFile     string            `long:"puppetserver.cert-file" description:"A PEM encoded certificate file for the Puppet Server. (default: --cert-file)" env:"PUPPETDB_PUPPETSERVER_CERT_FILE"`
+	PSKeyFile      string            `long:"puppetserver.key-file" description:"A PEM encoded private key file for the Puppet Server. (default: --key-file)" env:"PUPPETDB_PUPPETSERVER_KEY_FILE"`
+	PSCACertFile   string            `long:"puppetserver.ca-file" description:"A PEM encoded CA's certificate for the Puppet Server. (default: --ca-file)" env:"PUPPETDB_PUPPETSERVER_CA_FILE"`
+	PSSSLSkipVerif bool              `long:"puppetserver.ssl-skip-verify" description:"Skip SSL verification of the Puppet Server." env:"PUPPETDB_PUPPETSERVER_SSL_SKIP_VERIFY"`
+	CA             bool              `long:"collector.ca" description:"Export the certificates of the Puppet CA of --puppetserver.url by state and their expiry." env:"PUPPETDB_COLLECTOR_CA"`
+	ClassifierURL  string            `long:"pe.classifier-url" description:"Base URL of the PE node classifier API, e.g. https://pe-console:4433/classifier-api. The groups nodes are pinned to are attached to the per-node metrics as the node_groups label." env:"PUPPETDB_PE_CLASSIFIER_URL"`
+	CodeManagerURL string            `long:"pe.code-manager-url" description:"Base URL of the PE Code Manager API whose deployments are exported, e.g. https://puppet:8170/code-manager." env:"PUPPETDB_PE_CODE_MANAGER_URL"`
+	CodeMgrToken   string            `long:"pe.code-manager-token-file" description:"File holding an RBAC token for the Code Manager API, read for every request, which is otherwise authenticated with the client certificate." env:"PUPPETDB_PE_CODE_MANAGER_TOKEN_FILE"`
+	Patching       bool              `long:"collector.patching" description:"Export the package and security update counts and the reboot flag of the pe_patch or os_patching fact." env:"PUPPETDB_COLLECTOR_PATCHING"`
+	Packages       bool              `long:"collector.packages" description:"Export the number of packages installed on each node from the package inventory." env:"PUPPETDB_COLLECTOR_PACKAGES"`
+	PackageVers    []string          `long:"collector.package-version" description:"Package whose installed versions are exported by --collector.packages as puppet_package_info. Repeat for several packages." env:"PUPPETDB_COLLECTOR_PACKAGE_VERSION" env-delim:","`
+	SD             bool              `long:"sd.enabled" description:"Serve the active nodes as Prometheus HTTP service discovery targets at /sd." env:"PUPPETDB_SD_ENABLED"`
+	SDPort         int               `long:"sd.port" description:"Port appended to the certnames of the service discovery targets of /sd and --sd.file, none when 0." env:"PUPPETDB_SD_PORT" default:"0"`
+	SDFacts        []string          `long:"sd.facts" description:"Fact attached as a __meta_puppetdb_fact_<name> label to the service discovery targets. Repeat for several facts." env:"PUPPETDB_SD_FACTS" env-delim:","`
+	SDFile         string            `long:"sd.file" description:"File the active nodes are written to after each scrape, in the Prometheus file_sd format." env:"PUPPETDB_SD_FILE"`
+	SDFileLabels   map[string]string `long:"sd.file-label" description:"Fact attached as a label to the targets of --sd.file, given as fact:label. Repeat for several facts." env:"PUPPETDB_SD_FILE_LABEL" env-delim:","`
+	StateFile      string            `long:"state.file" description:"File the metrics are saved to after each successful scrape, and served at startup until a scrape fetches the nodes." env:"PUPPETDB_STATE_FILE"`
+	PushURL        string            `long:"push.url" description:"URL of a Pushgateway the metrics are pushed to after each scrape, e.g. http://pushgateway:9091." env:"PUPPETDB_PUSH_URL"`
+	PushJob        string            `long:"push.job" description:"Job the metrics are pushed to the Pushgateway under." env:"PUPPETDB_PUSH_JOB" default:"puppetdb_exporter"`
+	PushGrouping   map[string]string `long:"push.grouping" description:"Grouping label of the pushed metrics, given as name:value. Repeat for several labels." env:"PUPPETDB_PUSH_GROUPING" env-delim:","`
+	RemoteWrite    string            `long:"remote-write.url" description:"Remote write endpoint the metrics are pushed to after each scrape, e.g. http://mimir:9009/api/v1/push." env:"PUPPETDB_REMOTE_WRITE_URL"`
+	RWUsername     string            `long:"remote-write.username" description:"Basic authentication username of the remote write endpoint." env:"PUPPETDB_REMOTE_WRITE_USERNAME"`
+	RWPassword     string            `long:"remote-write.password" description:"Basic authentication password of the remote write endpoint." env:"PUPPETDB_REMOTE_WRITE_PASSWORD"`
+	RWPasswordFile string            `long:"remote-write.password-file" description:"File holding the basic authentication password of the remote write endpoint, read for every push." env:"PUPPETDB_REMOTE_WRITE_PASSWORD_FILE"`
+	RWCertFile     string            `long:"remote-write.cert-file" description:"A PEM encoded client certificate file for the remote write endpoint." env:"PUPPETDB_REMOTE_WRITE_CERT_FILE"`
+	RWKeyFile      string            `long:"remote-write.key-file" description:"A PEM encoded client private key file for the remote write endpoint." env:"PUPPETDB_REMOTE_WRITE_KEY_FILE"`
+	RWCACertFile   string            `long:"remote-write.ca-file" description:"A PEM encoded CA's certificate for the remote write endpoint. (default: system trust store)" env:"PUPPETDB_REMOTE_WRITE_CA_FILE"`
+	RWSSLSkipVerif bool              `long:"remote-write.ssl-skip-verify" description:"Skip SSL verification of the remote write endpoint." env:"PUPPETDB_REMOTE_WRITE_SSL_SKIP_VERIFY"`
+	RWLabels       map[string]string `long:"remote-write.label" description:"Label added to the remote written series, given as name:value. Repeat for several labels." env:"PUPPETDB_REMOTE_WRITE_LABEL" env-delim:"," default:"job:puppetdb_exporter"`
+	RWTimeout      string            `long:"remote-write.timeout" description:"Timeout of the remote write requests." env:"PUPPETDB_REMOTE_WRITE_TIMEOUT" default:"30s"`
+	AgentVersions  bool              `long:"collector.agent-version" description:"Count the nodes by Puppet agent version, from the aio_agent_version or puppetversion fact." env:"PUPPETDB_COLLECTOR_AGENT_VERSION"`
+	Producers      bool              `long:"collector.producer" description:"Count the nodes by Puppet Server which compiled their latest catalog and report status." env:"PUPPETDB_COLLECTOR_PRODUCER"`
+	OSVersions     bool              `long:"collector.os" description:"Count the nodes by operating system family and major release, from the os fact." env:"PUPPETDB_COLLECTOR_OS"`
+	Resources      bool              `long:"collector.resources" description:"Export the resource counts of the latest reports as puppet_report_resources{state}, in place of the resources category." env:"PUPPETDB_COLLECTOR_RESOURCES"`
+	NodeInfo       bool              `long:"collector.node-info" description:"Export the environment, Puppet agent version and operating system of every node as puppet_node_info, set to 1." env:"PUPPETDB_COLLECTOR_NODE_INFO"`
+	NodeStatus     bool              `long:"collector.node-status" description:"Export the status of every node as puppet_node_status{host,status}, 1 for its status and 0 for the other ones." env:"PUPPETDB_COLLECTOR_NODE_STATUS"`
+	RunQuantiles   bool              `long:"collector.run-duration-quantiles" description:"Export the 0.5, 0.9 and 0.99 quantiles of the total duration of the latest runs by environment as puppet_run_duration_seconds." env:"PUPPETDB_COLLECTOR_RUN_DURATION_QUANTILES"`
+	ResourceTotals bool              `long:"collector.resource-totals" description:"Export the resource counts summed across the latest reports of every node as puppet_resources_<state>_count." env:"PUPPETDB_COLLECTOR_RESOURCE_TOTALS"`
+	TotalsByEnv    bool              `long:"collector.resource-totals-by-environment" description:"Sum the resource counts of --collector.resource-totals per environment." env:"PUPPETDB_COLLECTOR_RESOURCE_TOTALS_BY_ENVIRONMENT"`
+	Events         bool              `long:"collector.events" description:"Export the event counts of the latest reports as puppet_report_event_counts{result}." env:"PUPPETDB_COLLECTOR_EVENTS"`
+	Logs           bool              `long:"collector.logs" description:"Export the warning and error log entry counts of the latest reports as puppet_report_logs{level}." env:"PUPPETDB_COLLECTOR_LOGS"`
+	FailedRes      bool              `long:"collector.failed-resources" description:"Export the resources which failed in the latest reports as puppet_failed_resource{resource_type,resource_title}." env:"PUPPETDB_COLLECTOR_FAILED_RESOURCES"`
+	FailedResLimit int               `long:"collector.failed-resources-limit" description:"Maximum number of puppet_failed_resource series." env:"PUPPETDB_COLLECTOR_FAILED_RESOURCES_LIMIT" default:"500"`
+	ReportAgeBkts  []float64         `long:"metrics.report-age-buckets" description:"Upper bounds in seconds of the buckets of puppetdb_report_age_nodes{le}, the count of active nodes by report age as of the latest scrape." env:"PUPPETDB_METRICS_REPORT_AGE_BUCKETS" env-delim:"," default:"300" default:"900" default:"1800" default:"3600" default:"7200" default:"21600" default:"86400" default:"604800"`
+	ReportTimes    bool              `long:"metrics.report-timestamps" description:"Export the puppet_report samples with the time of the report as sample timestamp. Such samples are not marked stale when nodes disappear." env:"PUPPETDB_METRICS_REPORT_TIMESTAMPS"`
+	FlappingRuns   int               `long:"collector.flapping-reports" description:"Number of latest reports of each node checked for flapping, 0 disables the check." env:"PUPPETDB_COLLECTOR_FLAPPING_REPORTS" default:"0"`
+	FlappingThres  int               `long:"collector.flapping-threshold" description:"Number of the checked reports which must have changed or failed for a node to be flapping." env:"PUPPETDB_COLLECTOR_FLAPPING_THRESHOLD" default:"3"`
+	Changes        bool              `long:"collector.changes" description:"Export the corrective and intentional changes of the latest reports, per node and per environment." env:"PUPPETDB_COLLECTOR_CHANGES"`
+
+	// creds are the credentials fetched from Vault or SPIFFE, the vault
+	// ones being due for renewal at vaultNext
+	creds     *tlsconfig.Credentials
+	vault     *vault.Client
+	vaultNext time.Time
 }
 
 var (
@@ -39,9 +209,704 @@ var (
 	commitSha1 = "<<< filled in by build >>>"
 )
 
+// clientOptions returns the options used to connect to PuppetDB
+func (c *Config) clientOptions() (*puppetdb.Options, error) {
+	timeouts := make(map[string]time.Duration, len(c.QueryTimeouts))
+	for queryType, value := range c.QueryTimeouts {
+		if !slices.Contains(puppetdb.QueryTypes, queryType) {
+			return nil, fmt.Errorf("unknown query type %q, expected one of %s", queryType, strings.Join(puppetdb.QueryTypes, ", "))
+		}
+
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s query timeout: %s", queryType, err)
+		}
+		timeouts[queryType] = timeout
+	}
+
+	if c.PageSize < 0 || c.PageConc < 1 {
+		return nil, fmt.Errorf("invalid node pages of %d nodes fetched %d at a time", c.PageSize, c.PageConc)
+	}
+
+	origin := c.Origin
+	if origin == "" {
+		origin = "prometheus-puppetdb-exporter/" + version
+	}
+
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	// The endpoints of the Kubernetes service are queried by address, while
+	// their certificates are issued for the name of the service
+	var serverName string
+	if c.K8sService != "" {
+		template, err := url.Parse(c.PuppetDBUrl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PuppetDB URL: %s", err)
+		}
+		serverName = template.Hostname()
+	}
+
+	return &puppetdb.Options{
+		URL:                 c.PuppetDBUrl,
+		Credentials:         creds,
+		CertPath:            c.CertFile,
+		CACertPath:          c.CACertFile,
+		KeyPath:             c.KeyFile,
+		SSLVerify:           !c.SSLSkipVerify,
+		CAAppendSystem:      c.CAAppendSystem,
+		ServerName:          serverName,
+		NodeQuery:           c.NodeQuery,
+		ActiveOnly:          c.ExclInactive && c.ExclInactiveCt,
+		Environments:        c.Environments,
+		ExcludeEnvironments: c.ExcludeEnvs,
+		Origin:              origin,
+		ReplicaURLs:         c.ReplicaURLs,
+		Timeouts:            timeouts,
+		PageSize:            c.PageSize,
+		PageConcurrency:     c.PageConc,
+		ConditionalRequests: c.Conditional,
+	}, nil
+}
+
+// puppetServer returns the client of the Puppet Server whose status is
+// exported, nil when none is configured
+func (c *Config) puppetServer(timeouts map[string]time.Duration) (*puppetserver.PuppetServer, error) {
+	if c.PuppetServer == "" {
+		return nil, nil
+	}
+
+	timeout, ok := timeouts[puppetdb.QueryStatus]
+	if !ok {
+		timeout = timeouts[puppetdb.QueryDefault]
+	}
+
+	creds, err := c.serviceCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return puppetserver.NewClient(&puppetserver.Options{
+		URL:         c.PuppetServer,
+		Credentials: creds,
+		CertPath:    cmp.Or(c.PSCertFile, c.CertFile),
+		KeyPath:     cmp.Or(c.PSKeyFile, c.KeyFile),
+		CACertPath:  cmp.Or(c.PSCACertFile, c.CACertFile),
+		SSLVerify:   !c.PSSSLSkipVerif,
+		Timeout:     timeout,
+	})
+}
+
+// classifier returns the client of the PE node classifier, nil when none is
+// configured
+func (c *Config) classifier(timeouts map[string]time.Duration) (*classifier.Classifier, error) {
+	if c.ClassifierURL == "" {
+		return nil, nil
+	}
+
+	timeout, ok := timeouts[puppetdb.QueryStatus]
+	if !ok {
+		timeout = timeouts[puppetdb.QueryDefault]
+	}
+
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return classifier.NewClient(&classifier.Options{
+		URL:         c.ClassifierURL,
+		Credentials: creds,
+		CertPath:    c.CertFile,
+		KeyPath:     c.KeyFile,
+		CACertPath:  c.CACertFile,
+		SSLVerify:   !c.SSLSkipVerify,
+		Timeout:     timeout,
+	})
+}
+
+// codeManager returns the client of the PE Code Manager, nil when none is
+// configured
+func (c *Config) codeManager(timeouts map[string]time.Duration) (*puppetserver.PuppetServer, error) {
+	if c.CodeManagerURL == "" {
+		return nil, nil
+	}
+
+	if c.CodeMgrToken != "" {
+		if _, err := secret.Read(c.CodeMgrToken); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout, ok := timeouts[puppetdb.QueryStatus]
+	if !ok {
+		timeout = timeouts[puppetdb.QueryDefault]
+	}
+
+	creds, err := c.serviceCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return puppetserver.NewClient(&puppetserver.Options{
+		URL:         c.CodeManagerURL,
+		Credentials: creds,
+		CertPath:    cmp.Or(c.PSCertFile, c.CertFile),
+		KeyPath:     cmp.Or(c.PSKeyFile, c.KeyFile),
+		CACertPath:  cmp.Or(c.PSCACertFile, c.CACertFile),
+		SSLVerify:   !c.PSSSLSkipVerif,
+		TokenPath:   c.CodeMgrToken,
+		Timeout:     timeout,
+	})
+}
+
+// pusher returns the Pushgateway client pushing the default registry, nil
+// when no Pushgateway is configured
+func (c *Config) pusher() *push.Pusher {
+	if c.PushURL == "" {
+		return nil
+	}
+
+	pusher := push.New(c.PushURL, c.PushJob).Gatherer(prometheus.DefaultGatherer)
+	for name, value := range c.PushGrouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	return pusher
+}
+
+// remoteWrite returns the remote write client pushing the default registry,
+// nil when no remote write endpoint is configured
+func (c *Config) remoteWrite() (*remotewrite.Client, error) {
+	if c.RemoteWrite == "" {
+		return nil, nil
+	}
+
+	timeout, err := time.ParseDuration(c.RWTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeout: %s", err)
+	}
+	if err := checkSecret(c.RWPassword, c.RWPasswordFile, "--remote-write.password"); err != nil {
+		return nil, err
+	}
+
+	return remotewrite.NewClient(&remotewrite.Options{
+		URL:          c.RemoteWrite,
+		Username:     c.RWUsername,
+		Password:     c.RWPassword,
+		PasswordPath: c.RWPasswordFile,
+		CertPath:     c.RWCertFile,
+		KeyPath:      c.RWKeyFile,
+		CACertPath:   c.RWCACertFile,
+		SSLVerify:    !c.RWSSLSkipVerif,
+		Labels:       c.RWLabels,
+		Timeout:      timeout,
+		Gatherer:     prometheus.DefaultGatherer,
+	})
+}
+
+// once runs a single scrape cycle and prints the metrics of the default
+// registry, it returns the exit status
+func once(exp *exporter.Exporter, c *Config) int {
+	status := 0
+	if err := exp.Once(c.UnreportedNode, c.Verbose); err != nil {
+		log.Errorf("scrape failed: %s", err)
+		status = 1
+	}
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Errorf("failed to gather metrics: %s", err)
+		return 1
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, mf); err != nil {
+			log.Errorf("failed to print metrics: %s", err)
+			return 1
+		}
+	}
+	return status
+}
+
+// hostMapper returns the certname to host label mapping, nil when the
+// certnames are used as is
+func (c *Config) hostMapper() (*exporter.HostMapper, error) {
+	if c.HostLookup == "" && c.HostRegex == "" && !c.HostStripDom {
+		return nil, nil
+	}
+
+	m := &exporter.HostMapper{
+		Replacement: c.HostReplace,
+		StripDomain: c.HostStripDom,
+	}
+
+	var err error
+	if c.HostLookup != "" {
+		if m.Lookup, err = exporter.LoadHostLookup(c.HostLookup); err != nil {
+			return nil, err
+		}
+	}
+	if m.Regex, err = compileFilter(c.HostRegex); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// jmxMBeans returns the MBeans patterns to export, none unless --collector.jmx
+// is set
+func (c *Config) jmxMBeans() []string {
+	if !c.JMX {
+		return nil
+	}
+	return c.JMXMBeans
+}
+
+// catalogResources returns the resources whose nodes are counted
+func (c *Config) catalogResources() ([]exporter.CatalogResource, error) {
+	resources := make([]exporter.CatalogResource, 0, len(c.CatalogRes))
+	for _, ref := range c.CatalogRes {
+		r, err := exporter.ParseCatalogResource(ref)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// thresholdOverrides returns the fact-based unreported durations
+func (c *Config) thresholdOverrides() ([]exporter.ThresholdOverride, error) {
+	overrides := make([]exporter.ThresholdOverride, 0, len(c.ThresholdOver))
+	for _, s := range c.ThresholdOver {
+		o, err := exporter.ParseThresholdOverride(s)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// reportMetrics returns the names of the report metrics exported by
+// category, nil when every metric of the exported categories is
+func (c *Config) reportMetrics() (map[string]map[string]struct{}, error) {
+	if len(c.CategoryMetric) == 0 {
+		return nil, nil
+	}
+
+	metrics := map[string]map[string]struct{}{}
+	for _, s := range c.CategoryMetric {
+		category, name, ok := strings.Cut(s, ".")
+		if !ok || category == "" || name == "" {
+			return nil, fmt.Errorf("invalid report metric %q, expected category.name", s)
+		}
+		if metrics[category] == nil {
+			metrics[category] = map[string]struct{}{}
+		}
+		metrics[category][name] = struct{}{}
+	}
+	return metrics, nil
+}
+
+// queries returns the user-defined queries, nil when no file is configured
+func (c *Config) queries() ([]exporter.Query, error) {
+	if c.QueriesFile == "" {
+		return nil, nil
+	}
+	return exporter.LoadQueries(c.QueriesFile)
+}
+
+// addTimestampLayouts makes the exporter parse timestamps with the configured
+// layouts and location
+func (c *Config) addTimestampLayouts() error {
+	location, err := time.LoadLocation(c.TimeLocation)
+	if err != nil {
+		return fmt.Errorf("failed to load timestamp location: %s", err)
+	}
+
+	exporter.TimestampLayouts = append(exporter.TimestampLayouts, c.TimeLayouts...)
+	exporter.TimestampLocation = location
+	return nil
+}
+
+// lock returns the leader lock, nil when no lock file is configured
+func (c *Config) lock() *leader.Lock {
+	if c.LockFile == "" {
+		return nil
+	}
+	return leader.New(c.LockFile)
+}
+
+// resolver returns the resolver discovering the PuppetDB servers, nil when
+// the configured URLs are used
+func (c *Config) resolver(timeouts map[string]time.Duration) (resolver.Resolver, error) {
+	var flags []string
+	if c.SRVRecord != "" {
+		flags = append(flags, "--puppetdb.srv-record")
+	}
+	if c.ConsulService != "" {
+		flags = append(flags, "--consul.service")
+	}
+	if c.K8sService != "" {
+		flags = append(flags, "--kubernetes.service")
+	}
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	if len(flags) > 1 {
+		return nil, fmt.Errorf("%s are exclusive", strings.Join(flags, " and "))
+	}
+	flag := flags[0]
+	if len(c.ReplicaURLs) > 0 {
+		return nil, fmt.Errorf("%s cannot be combined with --pe.replica-url", flag)
+	}
+
+	template, err := url.Parse(c.PuppetDBUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PuppetDB URL: %s", err)
+	}
+	if template.Scheme != "http" && template.Scheme != "https" {
+		return nil, fmt.Errorf("%s requires an http or https --puppetdb-url", flag)
+	}
+
+	if c.SRVRecord != "" {
+		return &resolver.SRV{Record: c.SRVRecord, Template: template}, nil
+	}
+
+	timeout, ok := timeouts[puppetdb.QueryStatus]
+	if !ok {
+		timeout = timeouts[puppetdb.QueryDefault]
+	}
+	if c.K8sService != "" {
+		return resolver.NewKubernetes(c.K8sService, c.K8sPortName, template, timeout)
+	}
+	if err := checkSecret(c.ConsulToken, c.ConsulTokenF, "--consul.token"); err != nil {
+		return nil, err
+	}
+	return resolver.NewConsul(&resolver.ConsulOptions{
+		Address:    strings.TrimRight(c.ConsulAddress, "/"),
+		Service:    c.ConsulService,
+		Tag:        c.ConsulTag,
+		Datacenter: c.ConsulDC,
+		Token:      c.ConsulToken,
+		TokenPath:  c.ConsulTokenF,
+		CertPath:   c.ConsulCertFile,
+		KeyPath:    c.ConsulKeyFile,
+		CACertPath: c.ConsulCAFile,
+		SSLVerify:  !c.ConsulSkipVer,
+		Timeout:    timeout,
+		Template:   template,
+	})
+}
+
+// credentials returns the client credentials fetched from Vault or the
+// SPIFFE Workload API, nil when neither is configured. They are fetched once,
+// SVIDs being then rotated by the Workload API and Vault credentials renewed
+// by renewCredentials.
+func (c *Config) credentials() (*tlsconfig.Credentials, error) {
+	if c.creds != nil {
+		return c.creds, nil
+	}
+
+	switch {
+	case c.VaultAddress != "" && c.SPIFFESocket != "":
+		return nil, fmt.Errorf("--vault.address and --spiffe.endpoint-socket are exclusive")
+	case c.SPIFFESocket != "":
+		creds := &tlsconfig.Credentials{}
+		source, err := spiffe.NewSource(c.SPIFFESocket, c.SPIFFEServerID, creds)
+		if err != nil {
+			return nil, err
+		}
+		if err := source.Start(context.Background(), 30*time.Second); err != nil {
+			return nil, fmt.Errorf("failed to fetch SVID: %s", err)
+		}
+		c.creds = creds
+		return creds, nil
+	case c.VaultAddress == "":
+		return nil, nil
+	}
+
+	if err := checkSecret(c.VaultToken, c.VaultTokenFile, "--vault.token"); err != nil {
+		return nil, err
+	}
+	refresh, err := time.ParseDuration(c.VaultKVRefresh)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Vault KV refresh interval: %s", err)
+	}
+	commonName := c.VaultCN
+	if commonName == "" {
+		if commonName, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := vault.NewClient(&vault.Options{
+		Address:    c.VaultAddress,
+		Token:      c.VaultToken,
+		TokenPath:  c.VaultTokenFile,
+		CACertPath: c.VaultCAFile,
+		SSLVerify:  !c.VaultSkipVerif,
+		PKIPath:    c.VaultPKIPath,
+		CommonName: commonName,
+		TTL:        c.VaultTTL,
+		KVPath:     c.VaultKVPath,
+		KVRefresh:  refresh,
+		Timeout:    time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &tlsconfig.Credentials{}
+	next, err := client.Fetch(context.Background(), creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials from Vault: %s", err)
+	}
+	c.creds, c.vault, c.vaultNext = creds, client, next
+	return creds, nil
+}
+
+// serviceCredentials returns the client credentials of the Puppet Server and
+// Code Manager, which use the Vault or SPIFFE ones unless their own
+// certificate is configured
+func (c *Config) serviceCredentials() (*tlsconfig.Credentials, error) {
+	if c.PSCertFile != "" {
+		return nil, nil
+	}
+	return c.credentials()
+}
+
+// renewCredentials renews the credentials fetched from Vault, if any, in the
+// background
+func (c *Config) renewCredentials() {
+	if c.vault != nil {
+		go c.vault.Renew(context.Background(), c.creds, c.vaultNext)
+	}
+}
+
+// checkSecret validates a secret given either by value or by its file, which
+// is read to report an unreadable one early
+func checkSecret(value, path, flag string) error {
+	if path == "" {
+		return nil
+	}
+	if value != "" {
+		return fmt.Errorf("%s and %s-file are exclusive", flag, flag)
+	}
+	_, err := secret.Read(path)
+	return err
+}
+
+// checkShard validates the shard flags
+func (c *Config) checkShard() error {
+	if c.ShardTotal < 1 {
+		return fmt.Errorf("shard total must be at least 1, got %d", c.ShardTotal)
+	}
+	if c.ShardIndex < 0 || c.ShardIndex >= c.ShardTotal {
+		return fmt.Errorf("shard index must be in [0, %d), got %d", c.ShardTotal, c.ShardIndex)
+	}
+	return nil
+}
+
+// compileFilter compiles an anchored regular expression, an empty expression
+// disables the filter
+func compileFilter(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func setupLogging(verbose bool) {
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+		log.Debugln("Enabling debug output")
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+}
+
+// exporterOptions returns the options of the exporter, along with the clients
+// of the other services it queries
+func (c *Config) exporterOptions(timeouts map[string]time.Duration) (*exporter.Options, error) {
+	// Create a map[string]struct{} of categories to provide an efficient way to
+	// find if a category exists in the list of categories.
+	cats := strings.Split(c.Categories, ",")
+	categories := make(map[string]struct{}, len(cats))
+	for _, category := range cats {
+		if category != categoriesAuto {
+			categories[category] = struct{}{}
+		}
+	}
+
+	scrapeTimeout, err := time.ParseDuration(c.ScrapeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scrape timeout: %s", err)
+	}
+	splay, err := time.ParseDuration(c.Splay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scrape splay: %s", err)
+	}
+	fullRefresh, err := time.ParseDuration(c.FullRefresh)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse full refresh interval: %s", err)
+	}
+	overlap, err := time.ParseDuration(c.Overlap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse incremental overlap: %s", err)
+	}
+
+	certnameInclude, err := compileFilter(c.CertnameIncl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certname include filter: %s", err)
+	}
+	certnameExclude, err := compileFilter(c.CertnameExcl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certname exclude filter: %s", err)
+	}
+
+	hostMapper, err := c.hostMapper()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure host label: %s", err)
+	}
+
+	puppetServer, err := c.puppetServer(timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Puppet Server client: %s", err)
+	}
+	if c.CA && puppetServer == nil {
+		return nil, errors.New("--collector.ca requires --puppetserver.url")
+	}
+
+	nodeClassifier, err := c.classifier(timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node classifier client: %s", err)
+	}
+
+	serverResolver, err := c.resolver(timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PuppetDB resolver: %s", err)
+	}
+
+	codeManager, err := c.codeManager(timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Code Manager client: %s", err)
+	}
+
+	catalogResources, err := c.catalogResources()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse catalog resources: %s", err)
+	}
+
+	thresholdOverrides, err := c.thresholdOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse unreported threshold overrides: %s", err)
+	}
+	reportMetrics, err := c.reportMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := c.queries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load queries: %s", err)
+	}
+
+	remoteWrite, err := c.remoteWrite()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote write client: %s", err)
+	}
+
+	return &exporter.Options{
+		Categories:                  categories,
+		AutoCategories:              slices.Contains(cats, categoriesAuto),
+		ExcludeCategories:           c.ExclCategories,
+		ReportMetrics:               reportMetrics,
+		CategoryLabels:              c.CategoryLabels,
+		ProblemNodesOnly:            c.ProblemNodes,
+		CertnameInclude:             certnameInclude,
+		CertnameExclude:             certnameExclude,
+		ShardIndex:                  c.ShardIndex,
+		ScrapeTimeout:               scrapeTimeout,
+		RawReportMetricNames:        c.ReportNames == "raw",
+		CatalogResources:            catalogResources,
+		Queries:                     queries,
+		Namespace:                   c.Namespace,
+		AggregateOnly:               c.AggregateOnly,
+		DropLabels:                  c.DropLabels,
+		RenameLabels:                c.RenameLabels,
+		MaxSeries:                   c.MaxSeries,
+		MaxSeriesPerMetric:          c.MaxSeriesPerMt,
+		Splay:                       splay,
+		FullRefreshInterval:         fullRefresh,
+		ConditionalRequests:         c.Conditional,
+		IncrementalOverlap:          overlap,
+		ShardTotal:                  c.ShardTotal,
+		ExcludeInactive:             c.ExclInactive,
+		ExcludeInactiveCounts:       c.ExclInactiveCt,
+		HostMapper:                  hostMapper,
+		SilenceFact:                 c.SilenceFact,
+		ThresholdFact:               c.ThresholdFact,
+		ThresholdOverrides:          thresholdOverrides,
+		FactMetrics:                 c.FactMetrics,
+		FactLabels:                  c.FactLabels,
+		AutoTune:                    c.AutoTune,
+		AutoTuneFraction:            c.AutoTuneFrac,
+		SeriesAudit:                 c.SeriesAudit,
+		AgentVersions:               c.AgentVersions,
+		Status:                      c.Status,
+		JMXMBeans:                   c.jmxMBeans(),
+		Commands:                    c.Commands,
+		Population:                  c.Population,
+		PuppetServer:                puppetServer,
+		CA:                          c.CA,
+		Classifier:                  nodeClassifier,
+		CodeManager:                 codeManager,
+		Patching:                    c.Patching,
+		Packages:                    c.Packages,
+		PackageVersions:             c.PackageVers,
+		SD:                          c.SD,
+		SDPort:                      c.SDPort,
+		SDFacts:                     c.SDFacts,
+		SDFile:                      c.SDFile,
+		SDFileLabels:                c.SDFileLabels,
+		StateFile:                   c.StateFile,
+		Pusher:                      c.pusher(),
+		RemoteWrite:                 remoteWrite,
+		Lock:                        c.lock(),
+		Resolver:                    serverResolver,
+		OSVersions:                  c.OSVersions,
+		Producers:                   c.Producers,
+		Resources:                   c.Resources,
+		ResourceTotals:              c.ResourceTotals || c.TotalsByEnv,
+		ResourceTotalsByEnvironment: c.TotalsByEnv,
+		RunDurationQuantiles:        c.RunQuantiles,
+		NodeStatus:                  c.NodeStatus,
+		NodeInfo:                    c.NodeInfo,
+		Events:                      c.Events,
+		Changes:                     c.Changes,
+		Logs:                        c.Logs,
+		FailedResources:             c.FailedRes,
+		FailedResourcesLimit:        c.FailedResLimit,
+		ReportAgeBuckets:            c.ReportAgeBkts,
+		ReportTimestamps:            c.ReportTimes,
+		FlappingReports:             c.FlappingRuns,
+		FlappingThreshold:           c.FlappingThres,
+	}, nil
+}
+
 func main() {
 	var c Config
 	parser := flags.NewParser(&c, flags.Default)
+	addCommands(parser, &c)
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if command == nil {
+			return nil
+		}
+		setupLogging(c.Verbose)
+		return command.Execute(args)
+	}
 	if _, err := parser.Parse(); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
@@ -49,49 +914,107 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if parser.Active != nil {
+		return
+	}
 
 	log.Printf("PuppetDB Metrics Exporter %s    build date: %s    sha1: %s    Go: %s",
 		version, buildDate, commitSha1,
 		runtime.Version(),
 	)
-	if c.Verbose {
-		log.SetLevel(log.DebugLevel)
-		log.Debugln("Enabling debug output")
-	} else {
-		log.SetLevel(log.InfoLevel)
-	}
+	setupLogging(c.Verbose)
 
 	if c.Version {
 		return
 	}
 
+	if c.TelemetryPath != "" {
+		c.MetricPath = c.TelemetryPath
+	}
+
 	interval, err := time.ParseDuration(c.ScrapeInterval)
 	if err != nil {
 		log.Fatalf("failed to parse scrape interval duration: %s", err)
 	}
+	if err := c.addTimestampLayouts(); err != nil {
+		log.Fatal(err)
+	}
 
-	// Create a map[string]struct{} of categories to provide an efficient way to
-	// find if a category exists in the list of categories.
-	cats := strings.Split(c.Categories, ",")
-	categories := make(map[string]struct{}, len(cats))
-	for _, category := range cats {
-		categories[category] = struct{}{}
+	if c.AutoTuneFrac <= 0 || c.AutoTuneFrac > 1 {
+		log.Fatalf("scrape auto-tune fraction must be in (0, 1], got %g", c.AutoTuneFrac)
+	}
+	if err := c.checkShard(); err != nil {
+		log.Fatal(err)
+	}
+	if c.Mock {
+		if c.MockNodes < 0 {
+			log.Fatalf("mock node count must not be negative, got %d", c.MockNodes)
+		}
+		if c.MockFailRate < 0 || c.MockFailRate > 1 {
+			log.Fatalf("mock failure rate must be in [0, 1], got %g", c.MockFailRate)
+		}
+		mock := puppetdbtest.NewMock(c.MockNodes, c.MockFailRate)
+		defer mock.Close()
+		log.Warnf("Serving the metrics of %d mock nodes, PuppetDB is not queried", c.MockNodes)
+		c.PuppetDBUrl = mock.QueryURL()
 	}
-	exp, err := exporter.NewPuppetDBExporter(c.PuppetDBUrl, c.CertFile, c.CACertFile, c.KeyFile, c.SSLSkipVerify, categories)
+
+	opts, err := c.clientOptions()
 	if err != nil {
-		log.Fatalf("failed to initialize exporter: %s", err)
+		log.Fatalf("invalid PuppetDB options: %s", err)
 	}
 
-	go exp.Scrape(interval, c.UnreportedNode, c.Verbose, categories)
+	expOpts, err := c.exporterOptions(opts.Timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exp, err := exporter.NewPuppetDBExporter(opts, expOpts)
+	if err != nil {
+		log.Fatalf("failed to initialize exporter: %s", err)
+	}
 
 	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "puppetdb_exporter_build_info",
-		Help: "puppetdb exporter build informations",
+		Namespace: c.Namespace,
+		Name:      "puppetdb_exporter_build_info",
+		Help:      "puppetdb exporter build informations",
 	}, []string{"version", "commit_sha", "build_date", "golang_version"})
 	buildInfo.WithLabelValues(version, commitSha1, buildDate, runtime.Version()).Set(1)
 	prometheus.MustRegister(buildInfo)
+	if c.NoGoMetrics {
+		prometheus.Unregister(collectors.NewGoCollector())
+	}
+	if c.NoProcMetrics {
+		prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	if c.Once {
+		os.Exit(once(exp, &c))
+	}
+	c.renewCredentials()
+	if c.StateFile != "" {
+		if err := exp.LoadState(); err != nil {
+			log.Warn(err)
+		}
+	}
+	go exp.Scrape(interval, c.UnreportedNode, c.Verbose)
 
-	http.Handle(c.MetricPath, promhttp.Handler())
+	http.Handle(c.MetricPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: !c.NoOpenMetrics,
+		}),
+	))
+	if c.SeriesAudit {
+		http.Handle("/debug/series", exp.AuditHandler())
+	}
+	if c.SD {
+		http.Handle("/sd", exp.SDHandler())
+	}
+	http.Handle("/readyz", exp.ReadyHandler())
+	http.Handle("/debug/last-scrape", exp.LastScrapeHandler())
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`
 <html>
@@ -104,6 +1027,33 @@ func main() {
 						`))
 	})
 
-	log.Infof("Providing metrics at %s%s", c.ListenAddress, c.MetricPath)
-	log.Fatal(http.ListenAndServe(c.ListenAddress, nil))
+	go func() {
+		<-exp.Started()
+		if err := systemd.Notify("READY=1"); err != nil {
+			log.Warn(err)
+		}
+	}()
+
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(listeners) > 0 {
+		log.Infof("Using %d sockets passed by systemd", len(listeners))
+	} else {
+		for _, address := range c.ListenAddress {
+			l, err := net.Listen("tcp", address)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+
+	errs := make(chan error)
+	for _, l := range listeners {
+		log.Infof("Providing metrics at %s%s", l.Addr(), c.MetricPath)
+		go func() { errs <- http.Serve(l, nil) }()
+	}
+	log.Fatal(<-errs)
 }
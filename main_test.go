@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb/puppetdbtest"
+)
+
+// writeKeyPair writes a self-signed client certificate and its key, and
+// returns their paths
+func writeKeyPair(t *testing.T) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestClientOptionsVerifyServer(t *testing.T) {
+	fake := puppetdbtest.NewServer(puppetdb.Node{Certname: "web1.example.com"})
+	defer fake.Close()
+	// The certificate of the server is not signed by a trusted CA
+	srv := httptest.NewTLSServer(fake.Config.Handler)
+	defer srv.Close()
+	certPath, keyPath := writeKeyPair(t)
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "default", wantErr: true},
+		{name: "skip verify", args: []string{"--ssl-skip-verify"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Config
+			args := append([]string{"-u", srv.URL + "/pdb/query", "--cert-file", certPath, "--key-file", keyPath}, tc.args...)
+			if _, err := flags.ParseArgs(&c, args); err != nil {
+				t.Fatalf("failed to parse flags: %s", err)
+			}
+
+			opts, err := c.clientOptions()
+			if err != nil {
+				t.Fatalf("failed to build client options: %s", err)
+			}
+			client, err := puppetdb.NewClient(opts)
+			if err != nil {
+				t.Fatalf("failed to create client: %s", err)
+			}
+
+			_, err = client.Nodes(context.Background())
+			if tc.wantErr && (err == nil || !strings.Contains(err.Error(), "certificate")) {
+				t.Errorf("expected a certificate verification error, got %v", err)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("failed to get nodes: %s", err)
+			}
+		})
+	}
+}
+
+func TestClientOptionsKubernetesServerName(t *testing.T) {
+	fake := puppetdbtest.NewServer(puppetdb.Node{Certname: "web1.example.com"})
+	defer fake.Close()
+	// The certificate of the server is issued for example.com
+	srv := httptest.NewTLSServer(fake.Config.Handler)
+	defer srv.Close()
+	certPath, keyPath := writeKeyPair(t)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: "example.com"},
+		{host: "puppetdb.example.org", wantErr: true},
+	} {
+		t.Run(tc.host, func(t *testing.T) {
+			var c Config
+			args := []string{
+				"-u", "https://" + tc.host + ":8081/pdb/query", "--kubernetes.service", "puppetdb",
+				"--cert-file", certPath, "--key-file", keyPath, "--ca-file", caPath,
+			}
+			if _, err := flags.ParseArgs(&c, args); err != nil {
+				t.Fatalf("failed to parse flags: %s", err)
+			}
+
+			opts, err := c.clientOptions()
+			if err != nil {
+				t.Fatalf("failed to build client options: %s", err)
+			}
+			client, err := puppetdb.NewClient(opts)
+			if err != nil {
+				t.Fatalf("failed to create client: %s", err)
+			}
+			// The resolver replaces the host of the URL with the address
+			// of the endpoint
+			if err := client.SetURLs([]string{srv.URL + "/pdb/query"}); err != nil {
+				t.Fatalf("failed to set URLs: %s", err)
+			}
+
+			_, err = client.Nodes(context.Background())
+			if tc.wantErr && (err == nil || !strings.Contains(err.Error(), "certificate")) {
+				t.Errorf("expected a certificate verification error, got %v", err)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("failed to get nodes: %s", err)
+			}
+		})
+	}
+}
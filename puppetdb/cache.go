@@ -0,0 +1,136 @@
+package puppetdb
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"reflect"
+)
+
+// cacheMaxEntries bounds the responses kept for conditional requests. The
+// least recently used one is evicted once full, e.g. after the timestamps of
+// incremental queries filled it with URLs never requested again.
+const cacheMaxEntries = 1024
+
+// cachedResponse is a decoded response kept along with its validators
+type cachedResponse struct {
+	header http.Header
+	// value is the object decoded from the response, of which every caller
+	// the response is reused for gets a copy
+	value        reflect.Value
+	etag         string
+	lastModified string
+	// used is the cache tick of the latest use of the response
+	used uint64
+}
+
+// conditionalQuery reports whether the responses of the query type are
+// cached and revalidated with conditional requests
+func (p *PuppetDB) conditionalQuery(queryType string) bool {
+	return p.options.ConditionalRequests && (queryType == QueryNodes || queryType == QueryFacts)
+}
+
+// fetchConditional is fetchHeader sending the validators of the previous
+// response of the URL, whose decoded object is reused without decoding
+// anything when PuppetDB, or a caching proxy in front of it, answers 304 Not
+// Modified. Revalidated tells whether it was.
+func (p *PuppetDB) fetchConditional(ctx context.Context, client *http.Client, queryType, myurl string, object interface{}) (header http.Header, revalidated bool, err error) {
+	p.mu.RLock()
+	cached, ok := p.cache[myurl]
+	p.mu.RUnlock()
+
+	validators := http.Header{}
+	if ok {
+		if cached.etag != "" {
+			validators.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			validators.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, body, err := request(ctx, client, myurl, validators)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok && resp.StatusCode == http.StatusNotModified {
+		p.mu.Lock()
+		p.cacheHits[queryType]++
+		p.cacheTick++
+		cached.used = p.cacheTick
+		p.mu.Unlock()
+		reflect.ValueOf(object).Elem().Set(copyValue(cached.value))
+		return cached.header, true, nil
+	}
+
+	if err := decode(resp, body, object); err != nil {
+		return nil, false, err
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode/100 == 2 && (etag != "" || lastModified != "") {
+		value := copyValue(reflect.ValueOf(object).Elem())
+
+		p.mu.Lock()
+		if _, ok := p.cache[myurl]; !ok && len(p.cache) >= cacheMaxEntries {
+			p.evictLocked()
+		}
+		p.cacheTick++
+		p.cache[myurl] = &cachedResponse{
+			header:       resp.Header,
+			value:        value,
+			etag:         etag,
+			lastModified: lastModified,
+			used:         p.cacheTick,
+		}
+		p.mu.Unlock()
+	}
+	return resp.Header, false, nil
+}
+
+// copyValue returns a copy of the decoded value, whose slice elements are
+// copied rather than shared, so that the callers changing the nodes or facts
+// they got do not change the cached response
+func copyValue(v reflect.Value) reflect.Value {
+	if v.Kind() != reflect.Slice || v.IsNil() {
+		return v
+	}
+	c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+	reflect.Copy(c, v)
+	return c
+}
+
+// evictLocked drops the least recently used response of the cache, p.mu
+// being held
+func (p *PuppetDB) evictLocked() {
+	var oldest string
+	var used uint64
+	for url, cached := range p.cache {
+		if oldest == "" || cached.used < used {
+			oldest, used = url, cached.used
+		}
+	}
+	delete(p.cache, oldest)
+}
+
+// CacheHits returns the count of responses reused after a conditional
+// request by query type
+func (p *PuppetDB) CacheHits() map[string]float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	hits := make(map[string]float64, len(p.cacheHits))
+	for queryType, count := range p.cacheHits {
+		hits[queryType] = count
+	}
+	return hits
+}
+
+// Decoded returns the count of responses decoded by query type. It does not
+// change across queries whose responses were all reused after a conditional
+// request, so that callers may reuse what they derived from them.
+func (p *PuppetDB) Decoded() map[string]uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return maps.Clone(p.decoded)
+}
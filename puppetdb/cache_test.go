@@ -0,0 +1,107 @@
+package puppetdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newETagServer starts a server answering every URL with a node and an ETag,
+// and 304 Not Modified when the request carries it. It counts the full
+// responses.
+func newETagServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var full atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `[{"certname": "web1.example.com"}]`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &full
+}
+
+func newConditionalClient(t *testing.T, url string) *PuppetDB {
+	t.Helper()
+
+	p, err := NewClient(&Options{URL: url + "/pdb/query", ConditionalRequests: true})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	return p
+}
+
+func TestConditionalRequestReuse(t *testing.T) {
+	srv, full := newETagServer(t)
+	p := newConditionalClient(t, srv.URL)
+
+	nodes, err := p.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err)
+	}
+	// Changing the nodes must not change the cached response
+	nodes[0].Certname = "changed"
+
+	nodes, err = p.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Certname != "web1.example.com" {
+		t.Errorf("got nodes %v, want the cached web1.example.com", nodes)
+	}
+	if got := full.Load(); got != 1 {
+		t.Errorf("got %d full responses, want 1", got)
+	}
+	if got := p.CacheHits()[QueryNodes]; got != 1 {
+		t.Errorf("got %g cache hits, want 1", got)
+	}
+	// Nothing was decoded for the reused response
+	if got := p.Decoded()[QueryNodes]; got != 1 {
+		t.Errorf("got %d decoded responses, want 1", got)
+	}
+}
+
+func TestConditionalRequestEviction(t *testing.T) {
+	srv, full := newETagServer(t)
+	p := newConditionalClient(t, srv.URL)
+	client := p.servers[0].client
+
+	fetch := func(i int) {
+		t.Helper()
+		var nodes []Node
+		if _, _, err := p.fetchConditional(context.Background(), client, QueryNodes, fmt.Sprintf("%s/%d", srv.URL, i), &nodes); err != nil {
+			t.Fatalf("failed to fetch %d: %s", i, err)
+		}
+	}
+
+	for i := range cacheMaxEntries {
+		fetch(i)
+	}
+	// The first response is used again, so that the second one is the
+	// least recently used when the cache overflows
+	fetch(0)
+	fetch(cacheMaxEntries)
+	if got := len(p.cache); got != cacheMaxEntries {
+		t.Errorf("got %d cached responses, want %d", got, cacheMaxEntries)
+	}
+	if _, ok := p.cache[srv.URL+"/1"]; ok {
+		t.Error("the least recently used response is still cached")
+	}
+
+	// The other responses are still revalidated rather than fetched again
+	before := full.Load()
+	fetch(0)
+	fetch(2)
+	fetch(1)
+	if got := full.Load() - before; got != 1 {
+		t.Errorf("got %d full responses, want 1 for the evicted response", got)
+	}
+}
@@ -0,0 +1,42 @@
+package puppetdb
+
+import (
+	"context"
+	"time"
+)
+
+// Client is the interface of the PuppetDB client consumed by the exporter,
+// implemented by PuppetDB
+type Client interface {
+	Nodes(ctx context.Context) ([]Node, error)
+	NodesSince(ctx context.Context, since time.Time) ([]Node, error)
+	Certnames(ctx context.Context) ([]string, error)
+	Facts(ctx context.Context, names []string) ([]Fact, error)
+	FactContents(ctx context.Context, paths [][]string) ([]FactContent, error)
+	PackageCounts(ctx context.Context) ([]PackageCount, error)
+	Packages(ctx context.Context, names []string) ([]Package, error)
+	ResourceCertnames(ctx context.Context, resourceType, title string) ([]string, error)
+	ReportMetrics(ctx context.Context, reportHash string) ([]ReportMetric, error)
+	NodeReports(ctx context.Context, certname string, limit int) ([]Report, error)
+	LatestReportProducers(ctx context.Context) ([]Report, error)
+	ReportLogs(ctx context.Context, reportHash string) ([]ReportLog, error)
+	EventCounts(ctx context.Context) ([]EventCount, error)
+	ChangeCounts(ctx context.Context) ([]ChangeCount, error)
+	FailedResources(ctx context.Context) ([]ResourceEvent, error)
+	Query(ctx context.Context, endpoint, query string) ([]map[string]interface{}, error)
+	MBeans(ctx context.Context, pattern string) (map[string]map[string]interface{}, error)
+
+	// Status, Failover, SetURLs and URLs manage the PuppetDB servers
+	// queries are sent to
+	Status(ctx context.Context) (*ServiceStatus, error)
+	Failover(ctx context.Context) []ServerStatus
+	SetURLs(urls []string) error
+	URLs() []string
+
+	DetectVersion(ctx context.Context) (string, error)
+	LastSuccess() map[string]time.Time
+	CacheHits() map[string]float64
+	Decoded() map[string]uint64
+}
+
+var _ Client = (*PuppetDB)(nil)
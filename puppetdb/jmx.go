@@ -0,0 +1,39 @@
+package puppetdb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// jolokiaEscaper escapes the characters of an MBean name which have a special
+// meaning in the path of Jolokia GET requests
+var jolokiaEscaper = strings.NewReplacer("!", "!!", "/", "!/", "\"", "!\"")
+
+// MBeans reads the attributes of the MBeans matching an object name pattern,
+// such as puppetlabs.puppetdb.mq:name=*, from the Jolokia metrics API. The
+// attributes are returned by MBean name.
+func (p *PuppetDB) MBeans(ctx context.Context, pattern string) (map[string]map[string]interface{}, error) {
+	if timeout := p.timeout(QueryStatus); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var response struct {
+		Status int                               `json:"status"`
+		Error  string                            `json:"error"`
+		Value  map[string]map[string]interface{} `json:"value"`
+	}
+	srv := p.current()
+	err := fetch(ctx, srv.client, srv.rootURL+"/metrics/v2/read/"+url.PathEscape(jolokiaEscaper.Replace(pattern)), &response)
+	p.succeeded(QueryStatus, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", pattern, err)
+	}
+	if response.Status != 200 {
+		return nil, fmt.Errorf("failed to read %s: %s", pattern, response.Error)
+	}
+	return response.Value, nil
+}
@@ -0,0 +1,113 @@
+package puppetdb
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// nodes returns the nodes matching the AST query. With PageSize, the first
+// page tells the total count of nodes, from which the offsets of the other
+// pages are planned and fetched PageConcurrency at a time.
+func (p *PuppetDB) nodes(ctx context.Context, query string) (nodes []Node, err error) {
+	params := url.Values{}
+	params.Set("query", query)
+	size := p.options.PageSize
+	if size <= 0 {
+		err = p.getParams(ctx, QueryNodes, "nodes", params, &nodes)
+		return
+	}
+
+	// Ordering by certname keeps the offsets stable from one page to the
+	// next, only shifted by the nodes added or removed meanwhile
+	params.Set("order_by", "[{\"field\": \"certname\"}]")
+	params.Set("limit", strconv.Itoa(size))
+	params.Set("include_total", "true")
+	header, err := p.getHeader(ctx, QueryNodes, "nodes", params, &nodes)
+	if err != nil {
+		return nil, err
+	}
+	params.Del("include_total")
+
+	total, err := strconv.Atoi(header.Get("X-Records"))
+	if err != nil {
+		return p.nextPages(ctx, params, nodes)
+	}
+	if total <= len(nodes) {
+		return nodes, nil
+	}
+
+	pages := make([][]Node, (total+size-1)/size)
+	pages[0] = nodes
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	slots := make(chan struct{}, max(p.options.PageConcurrency, 1))
+	for i := 1; i < len(pages) && ctx.Err() == nil; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			params := maps.Clone(params)
+			params.Set("offset", strconv.Itoa(i*size))
+			if pageErr := p.getParams(ctx, QueryNodes, "nodes", params, &pages[i]); pageErr != nil {
+				// The first error is the one which canceled the
+				// other pages
+				mu.Lock()
+				if err == nil {
+					err = pageErr
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	// A canceled context stops the pages from being fetched, without any
+	// of them failing when none was in flight
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("failed to get nodes: %s", ctxErr)
+	}
+
+	nodes = make([]Node, 0, total)
+	for _, page := range pages {
+		nodes = appendNew(nodes, page)
+	}
+	return nodes, nil
+}
+
+// nextPages fetches the pages following the first one in sequence, until a
+// page is not full, when PuppetDB does not tell the total count of nodes
+func (p *PuppetDB) nextPages(ctx context.Context, params url.Values, nodes []Node) ([]Node, error) {
+	size := p.options.PageSize
+	for offset, full := size, len(nodes) == size; full; offset += size {
+		var page []Node
+		params.Set("offset", strconv.Itoa(offset))
+		if err := p.getParams(ctx, QueryNodes, "nodes", params, &page); err != nil {
+			return nil, err
+		}
+		full = len(page) == size
+		nodes = appendNew(nodes, page)
+	}
+	return nodes, nil
+}
+
+// appendNew appends the nodes of the page to the list, except the last node
+// of the list which is repeated when a node was added before it while the
+// pages were fetched
+func appendNew(nodes, page []Node) []Node {
+	if len(nodes) > 0 && len(page) > 0 && page[0].Certname == nodes[len(nodes)-1].Certname {
+		page = page[1:]
+	}
+	return append(nodes, page...)
+}
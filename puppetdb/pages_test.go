@@ -0,0 +1,121 @@
+package puppetdb_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb/puppetdbtest"
+)
+
+// newPagedServer starts a fake PuppetDB serving count nodes ordered by
+// certname, and returns a client fetching them in pages of size nodes
+func newPagedServer(t *testing.T, count, size, concurrency int) (*puppetdbtest.Server, *puppetdb.PuppetDB) {
+	t.Helper()
+
+	nodes := make([]puppetdb.Node, count)
+	for i := range nodes {
+		nodes[i].Certname = fmt.Sprintf("node%02d", i)
+	}
+	srv := puppetdbtest.NewServer(nodes...)
+	t.Cleanup(srv.Close)
+
+	opts := srv.Options()
+	opts.PageSize = size
+	opts.PageConcurrency = concurrency
+	client, err := puppetdb.NewClient(opts)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	return srv, client
+}
+
+// certnames returns the certnames of the nodes
+func certnames(nodes []puppetdb.Node) []string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Certname
+	}
+	return names
+}
+
+func TestNodesPages(t *testing.T) {
+	srv, client := newPagedServer(t, 10, 3, 2)
+	// Fail is called with the lock of the server held
+	var offsets []int
+	srv.Fail = func(r *http.Request) bool {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		offsets = append(offsets, offset)
+		return false
+	}
+
+	nodes, err := client.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err)
+	}
+	if got, want := certnames(nodes), certnames(srv.Nodes); !slices.Equal(got, want) {
+		t.Errorf("got nodes %v, want %v", got, want)
+	}
+
+	// The last page only holds the 10th node
+	slices.Sort(offsets)
+	if want := []int{0, 3, 6, 9}; !slices.Equal(offsets, want) {
+		t.Errorf("got pages at offsets %v, want %v", offsets, want)
+	}
+}
+
+func TestNodesPagesShifted(t *testing.T) {
+	srv, client := newPagedServer(t, 10, 3, 1)
+	want := certnames(srv.Nodes)
+	// A node added before the first page once it is fetched shifts the
+	// next pages, whose first node repeats the last one of the page before
+	srv.Fail = func(r *http.Request) bool {
+		if r.URL.Query().Get("offset") == "3" {
+			srv.Nodes = slices.Insert(srv.Nodes, 0, puppetdb.Node{Certname: "node"})
+		}
+		return false
+	}
+
+	nodes, err := client.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get nodes: %s", err)
+	}
+	if got := certnames(nodes); !slices.Equal(got, want) {
+		t.Errorf("got nodes %v, want %v", got, want)
+	}
+}
+
+func TestNodesPageFailure(t *testing.T) {
+	srv, client := newPagedServer(t, 10, 3, 2)
+	srv.Fail = func(r *http.Request) bool {
+		return r.URL.Query().Get("offset") == "6"
+	}
+
+	nodes, err := client.Nodes(context.Background())
+	if err == nil {
+		t.Errorf("expected the failed page to fail the query, got %d nodes", len(nodes))
+	}
+}
+
+func TestNodesPagesCanceled(t *testing.T) {
+	srv, client := newPagedServer(t, 10, 3, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The context is canceled while the second page is served, so that the
+	// query fails rather than returning the nodes of the first page only
+	srv.Fail = func(r *http.Request) bool {
+		if r.URL.Query().Get("offset") == "3" {
+			cancel()
+		}
+		return false
+	}
+
+	nodes, err := client.Nodes(ctx)
+	if err == nil {
+		t.Errorf("expected the canceled query to fail, got %d nodes", len(nodes))
+	}
+}
@@ -0,0 +1,797 @@
+// Package puppetdb for PuppetDB data retrieval
+package puppetdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/internal/tlsconfig"
+)
+
+// PuppetDB stores informations used to connect to a PuppetDB
+type PuppetDB struct {
+	options *Options
+
+	mu      sync.RWMutex
+	servers []*server
+	// active is the server queries are sent to
+	active *server
+	// lastSuccess is the time of the latest successful query by query type
+	lastSuccess map[string]time.Time
+	// version is the major, minor and patch version of the PuppetDB, nil
+	// until DetectVersion succeeds
+	version *[3]int
+	// tlsConfig is shared by the HTTPS servers, loaded along the first one
+	tlsConfig *tls.Config
+	// cache holds the responses revalidated with conditional requests by
+	// URL, cacheHits counts the reused ones by query type, and cacheTick
+	// orders their uses
+	cache     map[string]*cachedResponse
+	cacheHits map[string]float64
+	cacheTick uint64
+	// decoded counts the decoded responses by query type
+	decoded map[string]uint64
+}
+
+// server is a PuppetDB server queries can be sent to
+type server struct {
+	url    string
+	client *http.Client
+	// baseURL is the URL queries are sent to, which differs from the
+	// configured URL when connecting through a Unix domain socket
+	baseURL string
+	// rootURL is the scheme and host of baseURL, under which the status API
+	// is served
+	rootURL string
+}
+
+// Options contains the options used to connect to a PuppetDB
+type Options struct {
+	URL        string
+	CertPath   string
+	CACertPath string
+	KeyPath    string
+	SSLVerify  bool
+	// Credentials replace CertPath and KeyPath when set, e.g. fetched from
+	// Vault
+	Credentials *tlsconfig.Credentials
+	// CAAppendSystem adds the CA certificate to the system trust store
+	// instead of trusting it alone
+	CAAppendSystem bool
+	// ServerName is the host name the certificates of the servers are
+	// verified against instead of the host of their URLs, e.g. the name of
+	// the Kubernetes service whose endpoints are queried by address
+	ServerName string
+	// NodeQuery is an AST query restricting the nodes returned by Nodes
+	NodeQuery string
+	// Environments and ExcludeEnvironments restrict the nodes returned by
+	// Nodes to, or exclude, the given report environments
+	Environments        []string
+	ExcludeEnvironments []string
+	// ActiveOnly restricts the nodes returned by Nodes to the active ones,
+	// i.e. neither deactivated nor expired
+	ActiveOnly bool
+	// Origin identifies the exporter in PuppetDB's query logs
+	Origin string
+	// ReplicaURLs are the URLs of PE replicas, in failover priority order
+	ReplicaURLs []string
+	// Timeouts bounds the duration of queries by query type, see the Query*
+	// constants. The QueryDefault entry applies to types without their own.
+	Timeouts map[string]time.Duration
+	// PageSize splits the nodes queries into pages of as many nodes, fetched
+	// PageConcurrency at a time, unless 0
+	PageSize        int
+	PageConcurrency int
+	// ConditionalRequests revalidates the previous responses of the nodes
+	// and facts queries with their ETag or Last-Modified validators
+	ConditionalRequests bool
+}
+
+// Query types used to configure timeouts
+const (
+	QueryDefault = "default"
+	QueryNodes   = "nodes"
+	QueryReports = "reports"
+	QueryCustom  = "query"
+	QueryStatus  = "status"
+	QueryFacts   = "facts"
+)
+
+// QueryTypes lists the query types accepted in Options.Timeouts
+var QueryTypes = []string{QueryDefault, QueryNodes, QueryReports, QueryCustom, QueryStatus, QueryFacts}
+
+// Node is a structure returned by a PuppetDB
+type Node struct {
+	Certname           string `json:"certname"`
+	Deactivated        string `json:"deactivated"`
+	Expired            string `json:"expired"`
+	LatestReportStatus string `json:"latest_report_status"`
+	ReportEnvironment  string `json:"report_environment"`
+	ReportTimestamp    string `json:"report_timestamp"`
+	LatestReportHash   string `json:"latest_report_hash"`
+	FactsTimestamp     string `json:"facts_timestamp"`
+	CatalogTimestamp   string `json:"catalog_timestamp"`
+	LatestReportNoop   bool   `json:"latest_report_noop"`
+	// CachedCatalogStatus is not_used, explicitly_requested or on_failure
+	CachedCatalogStatus string `json:"cached_catalog_status"`
+}
+
+// Report is a structure returned by a PuppetDB, holding the summary of a
+// report
+type Report struct {
+	Hash        string `json:"hash"`
+	Certname    string `json:"certname"`
+	Status      string `json:"status"`
+	ReceiveTime string `json:"receive_time"`
+	// Producer is the certname of the Puppet Server which compiled the
+	// catalog of the run
+	Producer string `json:"producer"`
+}
+
+// ReportMetric is a structure returned by a PuppetDB
+type ReportMetric struct {
+	Name     string  `json:"name"`
+	Value    float64 `json:"value"`
+	Category string  `json:"category"`
+}
+
+// Fact is a structure returned by a PuppetDB
+type Fact struct {
+	Certname    string      `json:"certname"`
+	Name        string      `json:"name"`
+	Value       interface{} `json:"value"`
+	Environment string      `json:"environment"`
+}
+
+// ReportLog is a structure returned by a PuppetDB, holding a log entry of a
+// report
+type ReportLog struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Source  string `json:"source"`
+}
+
+// FactContent is a structure returned by a PuppetDB, holding a value nested
+// in a structured fact
+type FactContent struct {
+	Certname    string        `json:"certname"`
+	Path        []interface{} `json:"path"`
+	Name        string        `json:"name"`
+	Value       interface{}   `json:"value"`
+	Environment string        `json:"environment"`
+}
+
+// EventCount is a structure returned by a PuppetDB, summarizing the events of
+// a node's latest report
+type EventCount struct {
+	SubjectType string `json:"subject_type"`
+	Subject     struct {
+		Title string `json:"title"`
+	} `json:"subject"`
+	Failures  int `json:"failures"`
+	Successes int `json:"successes"`
+	Noops     int `json:"noops"`
+	Skips     int `json:"skips"`
+}
+
+// ChangeCount is a structure returned by a PuppetDB, counting the changes of
+// a node's latest report which were, or were not, corrective
+type ChangeCount struct {
+	Certname         string `json:"certname"`
+	CorrectiveChange bool   `json:"corrective_change"`
+	Count            int    `json:"count"`
+}
+
+// ResourceEvent is a structure returned by a PuppetDB, identifying the
+// resource of an event
+type ResourceEvent struct {
+	Certname      string `json:"certname"`
+	ResourceType  string `json:"resource_type"`
+	ResourceTitle string `json:"resource_title"`
+}
+
+// Package is a structure returned by a PuppetDB, describing a package
+// installed on a node
+type Package struct {
+	Certname    string `json:"certname"`
+	PackageName string `json:"package_name"`
+	Version     string `json:"version"`
+	Provider    string `json:"provider"`
+}
+
+// PackageCount is a structure returned by a PuppetDB, counting the packages
+// installed on a node
+type PackageCount struct {
+	Certname string `json:"certname"`
+	Count    int    `json:"count"`
+}
+
+// NewClient creates a new PuppetDB client
+func NewClient(options *Options) (p *PuppetDB, err error) {
+	p = &PuppetDB{
+		options:     options,
+		lastSuccess: map[string]time.Time{},
+		cache:       map[string]*cachedResponse{},
+		cacheHits:   map[string]float64{},
+		decoded:     map[string]uint64{},
+	}
+
+	if options.NodeQuery != "" {
+		var query []interface{}
+		if err = json.Unmarshal([]byte(options.NodeQuery), &query); err != nil {
+			err = fmt.Errorf("node query is not a valid AST query: %s", err)
+			return nil, err
+		}
+	}
+
+	for _, rawURL := range append([]string{options.URL}, options.ReplicaURLs...) {
+		srv, err := p.newServer(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		p.servers = append(p.servers, srv)
+	}
+	p.active = p.servers[0]
+
+	return
+}
+
+// SetURLs replaces the servers queries can be sent to, in failover priority
+// order, e.g. when they are discovered. The active server is kept when it
+// remains, the first one used otherwise.
+func (p *PuppetDB) SetURLs(urls []string) error {
+	if len(urls) == 0 {
+		return fmt.Errorf("no PuppetDB URL")
+	}
+
+	p.mu.RLock()
+	existing := make(map[string]*server, len(p.servers))
+	for _, srv := range p.servers {
+		existing[srv.url] = srv
+	}
+	p.mu.RUnlock()
+
+	servers := make([]*server, 0, len(urls))
+	for _, rawURL := range urls {
+		srv, ok := existing[rawURL]
+		if !ok {
+			var err error
+			if srv, err = p.newServer(rawURL); err != nil {
+				return err
+			}
+		}
+		servers = append(servers, srv)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !slices.Contains(servers, p.active) {
+		p.active = servers[0]
+	}
+	p.servers = servers
+	return nil
+}
+
+// URLs returns the URLs of the servers queries can be sent to
+func (p *PuppetDB) URLs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	urls := make([]string, len(p.servers))
+	for i, srv := range p.servers {
+		urls[i] = srv.url
+	}
+	return urls
+}
+
+// newServer creates a server, loading the TLS configuration on the first
+// HTTPS one
+func (p *PuppetDB) newServer(rawURL string) (*server, error) {
+	puppetdbURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PuppetDB URL: %v", err)
+	}
+
+	if puppetdbURL.Scheme == "https" && p.tlsConfig == nil {
+		p.tlsConfig, err = loadTLSConfig(p.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newServer(puppetdbURL, p.tlsConfig)
+}
+
+func loadTLSConfig(options *Options) (*tls.Config, error) {
+	config, err := tlsconfig.Load(&tlsconfig.Files{
+		CertPath:           options.CertPath,
+		KeyPath:            options.KeyPath,
+		CACertPath:         options.CACertPath,
+		CAAppendSystem:     options.CAAppendSystem,
+		InsecureSkipVerify: !options.SSLVerify,
+		Credentials:        options.Credentials,
+	})
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = options.ServerName
+	return config, nil
+}
+
+func newServer(puppetdbURL *url.URL, tlsConfig *tls.Config) (*server, error) {
+	srv := &server{
+		url:     puppetdbURL.String(),
+		baseURL: puppetdbURL.String(),
+	}
+
+	var transport *http.Transport
+	switch puppetdbURL.Scheme {
+	case "https":
+		transport = &http.Transport{TLSClientConfig: tlsConfig}
+	case "http":
+		transport = &http.Transport{}
+	case "unix":
+		socket, prefix := splitSocketPath(puppetdbURL.Path)
+		if socket == "" {
+			return nil, fmt.Errorf("missing socket path in %s", puppetdbURL)
+		}
+
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		srv.baseURL = "http://unix" + prefix
+	default:
+		return nil, fmt.Errorf("%s is not a valid http scheme", puppetdbURL.Scheme)
+	}
+
+	srv.client = &http.Client{Transport: transport}
+	base, _ := url.Parse(srv.baseURL)
+	srv.rootURL = fmt.Sprintf("%s://%s", base.Scheme, base.Host)
+
+	return srv, nil
+}
+
+// splitSocketPath splits the path of a unix:// URL into the socket path and
+// the HTTP path prefix. The socket path ends with the first element ending in
+// ".sock", e.g. /var/run/puppetdb.sock/pdb/query is the socket
+// /var/run/puppetdb.sock with the prefix /pdb/query. Without such an element
+// the whole path is the socket.
+func splitSocketPath(p string) (socket, prefix string) {
+	elements := strings.Split(p, "/")
+	for i, element := range elements {
+		if strings.HasSuffix(element, ".sock") {
+			return strings.Join(elements[:i+1], "/"), strings.Join(append([]string{""}, elements[i+1:]...), "/")
+		}
+	}
+	return p, ""
+}
+
+// Nodes returns the list of nodes
+func (p *PuppetDB) Nodes(ctx context.Context) (nodes []Node, err error) {
+	nodes, err = p.nodes(ctx, p.nodesQuery())
+	if err != nil {
+		err = fmt.Errorf("failed to get nodes: %s", err)
+		return
+	}
+	return
+}
+
+// NodesSince returns the nodes whose report, facts or catalog were stored, or
+// which were deactivated or expired, after the given time
+func (p *PuppetDB) NodesSince(ctx context.Context, since time.Time) (nodes []Node, err error) {
+	t := since.UTC().Format(time.RFC3339)
+	clause := fmt.Sprintf("[\"or\", [\">\", \"report_timestamp\", %[1]q], [\">\", \"facts_timestamp\", %[1]q], "+
+		"[\">\", \"catalog_timestamp\", %[1]q], [\">\", \"deactivated\", %[1]q], [\">\", \"expired\", %[1]q]]", t)
+
+	nodes, err = p.nodes(ctx, p.nodesQuery(clause))
+	if err != nil {
+		err = fmt.Errorf("failed to get nodes since %s: %s", t, err)
+		return
+	}
+	return
+}
+
+// Certnames returns the certnames of the nodes Nodes returns, without their
+// other fields
+func (p *PuppetDB) Certnames(ctx context.Context) (certnames []string, err error) {
+	nodes, err := p.nodes(ctx, fmt.Sprintf("[\"extract\", [\"certname\"], %s]", p.nodesClauses()))
+	if err != nil {
+		err = fmt.Errorf("failed to get certnames: %s", err)
+		return
+	}
+
+	certnames = make([]string, len(nodes))
+	for i, node := range nodes {
+		certnames[i] = node.Certname
+	}
+	return
+}
+
+// nodeFields are the fields of the nodes decoded into Node, extracted by the
+// nodes queries instead of the full node objects
+var nodeFields = []string{
+	"certname", "deactivated", "expired", "latest_report_status", "report_environment",
+	"report_timestamp", "latest_report_hash", "facts_timestamp", "catalog_timestamp",
+	"latest_report_noop", "cached_catalog_status",
+}
+
+// nodesQuery returns the AST query extracting the fields of the nodes, active
+// and inactive unless ActiveOnly is set, matching the configured node query
+// and environments along with the extra clauses
+func (p *PuppetDB) nodesQuery(extra ...string) string {
+	fields, _ := json.Marshal(nodeFields)
+	return fmt.Sprintf("[\"extract\", %s, %s]", fields, p.nodesClauses(extra...))
+}
+
+// nodesClauses returns the clauses of nodesQuery
+func (p *PuppetDB) nodesClauses(extra ...string) string {
+	clauses := []string{"[\"or\", [\"=\", [\"node\", \"active\"], false], [\"=\", [\"node\", \"active\"], true]]"}
+	if p.options.ActiveOnly {
+		clauses[0] = "[\"=\", [\"node\", \"active\"], true]"
+	}
+	if p.options.NodeQuery != "" {
+		clauses = append(clauses, p.options.NodeQuery)
+	}
+	if len(p.options.Environments) > 0 {
+		clauses = append(clauses, inQuery("report_environment", p.options.Environments))
+	}
+	if len(p.options.ExcludeEnvironments) > 0 {
+		clauses = append(clauses, fmt.Sprintf("[\"not\", %s]", inQuery("report_environment", p.options.ExcludeEnvironments)))
+	}
+	clauses = append(clauses, extra...)
+
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return fmt.Sprintf("[\"and\", %s]", strings.Join(clauses, ", "))
+}
+
+// inQuery returns an AST query matching the field against a list of values
+func inQuery(field string, values []string) string {
+	array, _ := json.Marshal(values)
+	return fmt.Sprintf("[\"in\", %q, [\"array\", %s]]", field, array)
+}
+
+// Facts returns the facts of the given names of every node
+func (p *PuppetDB) Facts(ctx context.Context, names []string) (facts []Fact, err error) {
+	err = p.get(ctx, QueryFacts, "facts", inQuery("name", names), &facts)
+	if err != nil {
+		err = fmt.Errorf("failed to get facts: %s", err)
+		return
+	}
+	return
+}
+
+// FactContents returns the values found at the given paths into the facts of
+// every node
+func (p *PuppetDB) FactContents(ctx context.Context, paths [][]string) (contents []FactContent, err error) {
+	clauses := make([]interface{}, 0, len(paths)+1)
+	clauses = append(clauses, "or")
+	for _, path := range paths {
+		clauses = append(clauses, []interface{}{"=", "path", path})
+	}
+	query, _ := json.Marshal(clauses)
+
+	err = p.get(ctx, QueryFacts, "fact-contents", string(query), &contents)
+	if err != nil {
+		err = fmt.Errorf("failed to get fact contents: %s", err)
+		return
+	}
+	return
+}
+
+// PackageCounts returns the number of packages installed on every node
+func (p *PuppetDB) PackageCounts(ctx context.Context) (counts []PackageCount, err error) {
+	query := "[\"extract\", [\"certname\", [\"function\", \"count\"]], [\"group_by\", \"certname\"]]"
+
+	err = p.get(ctx, QueryFacts, "package-inventory", query, &counts)
+	if err != nil {
+		err = fmt.Errorf("failed to get package counts: %s", err)
+		return
+	}
+	return
+}
+
+// Packages returns the packages of the given names installed on every node
+func (p *PuppetDB) Packages(ctx context.Context, names []string) (packages []Package, err error) {
+	err = p.get(ctx, QueryFacts, "package-inventory", inQuery("package_name", names), &packages)
+	if err != nil {
+		err = fmt.Errorf("failed to get packages: %s", err)
+		return
+	}
+	return
+}
+
+// ResourceCertnames returns the certnames of the active nodes whose catalog
+// holds a resource of the given type, and of the given title unless empty
+func (p *PuppetDB) ResourceCertnames(ctx context.Context, resourceType, title string) (certnames []string, err error) {
+	clauses := []interface{}{"and", []interface{}{"=", []string{"node", "active"}, true}, []string{"=", "type", resourceType}}
+	if title != "" {
+		clauses = append(clauses, []string{"=", "title", title})
+	}
+	query, _ := json.Marshal([]interface{}{"extract", []string{"certname"}, clauses, []string{"group_by", "certname"}})
+
+	var rows []struct {
+		Certname string `json:"certname"`
+	}
+	err = p.get(ctx, QueryNodes, "resources", string(query), &rows)
+	if err != nil {
+		err = fmt.Errorf("failed to get nodes with %s[%s]: %s", resourceType, title, err)
+		return
+	}
+
+	certnames = make([]string, len(rows))
+	for i, row := range rows {
+		certnames[i] = row.Certname
+	}
+	return
+}
+
+// ReportMetrics returns the list of reportMetrics
+func (p *PuppetDB) ReportMetrics(ctx context.Context, reportHash string) (reportMetrics []ReportMetric, err error) {
+	err = p.get(ctx, QueryReports, "reports/"+reportHash+"/metrics", "", &reportMetrics)
+	if err != nil {
+		err = fmt.Errorf("failed to get reports: %s", err)
+		return
+	}
+	return
+}
+
+// NodeReports returns the latest reports of a node, most recent first
+func (p *PuppetDB) NodeReports(ctx context.Context, certname string, limit int) (reports []Report, err error) {
+	query, _ := json.Marshal([]interface{}{"extract", []string{"hash", "status", "receive_time"}, []string{"=", "certname", certname}})
+
+	params := url.Values{}
+	params.Set("query", string(query))
+	params.Set("order_by", "[{\"field\": \"receive_time\", \"order\": \"desc\"}]")
+	params.Set("limit", strconv.Itoa(limit))
+
+	err = p.getParams(ctx, QueryReports, "reports", params, &reports)
+	if err != nil {
+		err = fmt.Errorf("failed to get reports of %s: %s", certname, err)
+		return
+	}
+	return
+}
+
+// LatestReportProducers returns the certname and producer of the latest report
+// of every node
+func (p *PuppetDB) LatestReportProducers(ctx context.Context) (reports []Report, err error) {
+	if !p.supports(featureProducer) {
+		return nil, unsupported(featureProducer)
+	}
+	err = p.get(ctx, QueryReports, "reports", "[\"extract\", [\"certname\", \"producer\"], [\"=\", \"latest_report?\", true]]", &reports)
+	if err != nil {
+		err = fmt.Errorf("failed to get report producers: %s", err)
+		return
+	}
+	return
+}
+
+// ReportLogs returns the log entries of a report
+func (p *PuppetDB) ReportLogs(ctx context.Context, reportHash string) (logs []ReportLog, err error) {
+	err = p.get(ctx, QueryReports, "reports/"+reportHash+"/logs", "", &logs)
+	if err != nil {
+		err = fmt.Errorf("failed to get report logs: %s", err)
+		return
+	}
+	return
+}
+
+// EventCounts returns the counts of events of the latest report of every node
+func (p *PuppetDB) EventCounts(ctx context.Context) (counts []EventCount, err error) {
+	params := url.Values{}
+	params.Set("query", "[\"=\", \"latest_report?\", true]")
+	params.Set("summarize_by", "certname")
+
+	err = p.getParams(ctx, QueryReports, "event-counts", params, &counts)
+	if err != nil {
+		err = fmt.Errorf("failed to get event counts: %s", err)
+		return
+	}
+	return
+}
+
+// ChangeCounts returns the counts of corrective and intentional changes of the
+// latest report of every node
+func (p *PuppetDB) ChangeCounts(ctx context.Context) (counts []ChangeCount, err error) {
+	query := "[\"extract\", [\"certname\", \"corrective_change\", [\"function\", \"count\"]], " +
+		"[\"and\", [\"=\", \"latest_report?\", true], [\"=\", \"status\", \"success\"]], " +
+		"[\"group_by\", \"certname\", \"corrective_change\"]]"
+
+	err = p.get(ctx, QueryReports, "events", query, &counts)
+	if err != nil {
+		err = fmt.Errorf("failed to get change counts: %s", err)
+		return
+	}
+	return
+}
+
+// FailedResources returns the resources which failed in the latest report of
+// every node
+func (p *PuppetDB) FailedResources(ctx context.Context) (events []ResourceEvent, err error) {
+	query := "[\"extract\", [\"certname\", \"resource_type\", \"resource_title\"], " +
+		"[\"and\", [\"=\", \"latest_report?\", true], [\"=\", \"status\", \"failure\"]]]"
+
+	err = p.get(ctx, QueryReports, "events", query, &events)
+	if err != nil {
+		err = fmt.Errorf("failed to get failed resources: %s", err)
+		return
+	}
+	return
+}
+
+// Query runs an arbitrary query and returns the decoded rows. An empty endpoint
+// sends the query to the root endpoint, which expects PQL.
+func (p *PuppetDB) Query(ctx context.Context, endpoint, query string) (rows []map[string]interface{}, err error) {
+	err = p.get(ctx, QueryCustom, endpoint, query, &rows)
+	if err != nil {
+		err = fmt.Errorf("failed to run query: %s", err)
+		return
+	}
+	return
+}
+
+// timeout returns the timeout of the given query type
+func (p *PuppetDB) timeout(queryType string) time.Duration {
+	if timeout, ok := p.options.Timeouts[queryType]; ok {
+		return timeout
+	}
+	return p.options.Timeouts[QueryDefault]
+}
+
+// LastSuccess returns the time of the latest successful query by query type,
+// see the Query* constants
+func (p *PuppetDB) LastSuccess() map[string]time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	times := make(map[string]time.Time, len(p.lastSuccess))
+	for queryType, t := range p.lastSuccess {
+		times[queryType] = t
+	}
+	return times
+}
+
+// succeeded records a successful query of the given type
+func (p *PuppetDB) succeeded(queryType string, err error) {
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSuccess[queryType] = time.Now()
+}
+
+// current returns the server queries are sent to
+func (p *PuppetDB) current() *server {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.active
+}
+
+func (p *PuppetDB) get(ctx context.Context, queryType, endpoint, query string, object interface{}) (err error) {
+	params := url.Values{}
+	if query != "" {
+		params.Set("query", query)
+	}
+	return p.getParams(ctx, queryType, endpoint, params, object)
+}
+
+// getParams is get with arbitrary query parameters
+func (p *PuppetDB) getParams(ctx context.Context, queryType, endpoint string, params url.Values, object interface{}) (err error) {
+	_, err = p.getHeader(ctx, queryType, endpoint, params, object)
+	return
+}
+
+// getHeader is getParams returning the response headers
+func (p *PuppetDB) getHeader(ctx context.Context, queryType, endpoint string, params url.Values, object interface{}) (header http.Header, err error) {
+	srv := p.current()
+	myurl := strings.TrimRight(srv.baseURL, "/") + "/v4"
+	if endpoint != "" {
+		myurl += "/" + endpoint
+	}
+
+	if p.options.Origin != "" && p.supports(featureOrigin) {
+		params.Set("origin", p.options.Origin)
+	}
+
+	// Let PuppetDB abort the query on its side, and give up waiting for
+	// it on ours in case it does not.
+	if timeout := p.timeout(queryType); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		if p.supports(featureTimeout) {
+			params.Set("timeout", strconv.Itoa(int(math.Ceil(timeout.Seconds()))))
+		}
+	}
+
+	if len(params) > 0 {
+		myurl += "?" + params.Encode()
+	}
+	var revalidated bool
+	if p.conditionalQuery(queryType) {
+		header, revalidated, err = p.fetchConditional(ctx, srv.client, queryType, myurl, object)
+	} else {
+		header, err = fetchHeader(ctx, srv.client, myurl, object)
+	}
+	p.succeeded(queryType, err)
+	if err == nil && !revalidated {
+		p.mu.Lock()
+		p.decoded[queryType]++
+		p.mu.Unlock()
+	}
+	return
+}
+
+// fetch calls the given URL and decodes its JSON response into object
+func fetch(ctx context.Context, client *http.Client, myurl string, object interface{}) (err error) {
+	_, err = fetchHeader(ctx, client, myurl, object)
+	return
+}
+
+// fetchHeader is fetch returning the response headers
+func fetchHeader(ctx context.Context, client *http.Client, myurl string, object interface{}) (header http.Header, err error) {
+	resp, body, err := request(ctx, client, myurl, nil)
+	if err != nil {
+		return
+	}
+	return resp.Header, decode(resp, body, object)
+}
+
+// request calls the given URL with the extra headers and reads the response
+func request(ctx context.Context, client *http.Client, myurl string, header http.Header) (resp *http.Response, body []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", myurl, strings.NewReader(""))
+	if err != nil {
+		err = fmt.Errorf("failed to build request: %s", err)
+		return
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to call API: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read response: %s", err)
+		return
+	}
+	return
+}
+
+// decode decodes the JSON body of the response into object
+func decode(resp *http.Response, body []byte, object interface{}) (err error) {
+	err = json.Unmarshal(body, object)
+	if err != nil && resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body[:min(len(body), 512)]))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal: %s", err)
+		return
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package puppetdbtest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// mockRunInterval is the interval between the Puppet runs of mock nodes
+const mockRunInterval = 30 * time.Minute
+
+// mockEnvironments are the environments of mock nodes, cycled through
+var mockEnvironments = []string{
+	"production", "production", "production", "production", "production",
+	"production", "production", "production", "staging", "development",
+}
+
+// NewMock starts a fake PuppetDB simulating a fleet of count nodes which run
+// Puppet every 30 minutes, spread over the interval, and whose runs fail
+// with the given rate. The reports are updated as the runs go by.
+func NewMock(count int, failureRate float64) *Server {
+	s := NewServer()
+	s.refresh = func(now time.Time) {
+		s.mock(now, count, failureRate)
+	}
+	s.refresh(time.Now())
+	return s
+}
+
+// mock replaces the nodes, report metrics and logs and facts with those of
+// the latest runs of the mock nodes at the given time
+func (s *Server) mock(now time.Time, count int, failureRate float64) {
+	s.Nodes = make([]puppetdb.Node, 0, count)
+	s.ReportMetrics = make(map[string][]puppetdb.ReportMetric, count)
+	s.ReportLogs = map[string][]puppetdb.ReportLog{}
+	s.Facts = make([]puppetdb.Fact, 0, 3*count)
+
+	for i := range count {
+		certname := fmt.Sprintf("node%04d.example.com", i+1)
+		environment := mockEnvironments[i%len(mockEnvironments)]
+
+		// Each node runs at its own offset within the run interval
+		offset := mockRunInterval * time.Duration(i) / time.Duration(count)
+		run := now.Add(-offset).UnixNano() / int64(mockRunInterval)
+		runTime := time.Unix(0, run*int64(mockRunInterval)).Add(offset)
+		rng := rand.New(rand.NewPCG(uint64(i), uint64(run)))
+		hash := fmt.Sprintf("%016x%08x", run, i)
+
+		status := "unchanged"
+		var failed, changed float64
+		switch r := rng.Float64(); {
+		case r < failureRate:
+			status = "failed"
+			failed = float64(1 + rng.IntN(3))
+			s.ReportLogs[hash] = []puppetdb.ReportLog{{
+				Level:   "err",
+				Message: "Could not evaluate: mock failure",
+				Source:  "Puppet",
+			}}
+		case r < failureRate+0.2:
+			status = "changed"
+			changed = float64(1 + rng.IntN(5))
+		}
+
+		total := float64(100 + rng.IntN(400))
+		configRetrieval := 1 + 4*rng.Float64()
+		s.ReportMetrics[hash] = []puppetdb.ReportMetric{
+			{Category: "time", Name: "total", Value: configRetrieval + 5 + 40*rng.Float64()},
+			{Category: "time", Name: "config_retrieval", Value: configRetrieval},
+			{Category: "resources", Name: "total", Value: total},
+			{Category: "resources", Name: "changed", Value: changed},
+			{Category: "resources", Name: "failed", Value: failed},
+			{Category: "resources", Name: "out_of_sync", Value: changed + failed},
+			{Category: "resources", Name: "skipped", Value: 0},
+			{Category: "events", Name: "success", Value: changed},
+			{Category: "events", Name: "failure", Value: failed},
+			{Category: "events", Name: "total", Value: changed + failed},
+			{Category: "changes", Name: "total", Value: changed},
+		}
+
+		timestamp := runTime.UTC().Format(time.RFC3339)
+		s.Nodes = append(s.Nodes, puppetdb.Node{
+			Certname:            certname,
+			LatestReportStatus:  status,
+			ReportEnvironment:   environment,
+			ReportTimestamp:     timestamp,
+			LatestReportHash:    hash,
+			FactsTimestamp:      timestamp,
+			CatalogTimestamp:    timestamp,
+			CachedCatalogStatus: "not_used",
+		})
+
+		s.Facts = append(s.Facts,
+			puppetdb.Fact{Certname: certname, Name: "aio_agent_version", Value: []string{"8.10.0", "7.34.0"}[i%2], Environment: environment},
+			puppetdb.Fact{Certname: certname, Name: "processorcount", Value: 2 << (i % 3), Environment: environment},
+			puppetdb.Fact{Certname: certname, Name: "os", Value: map[string]interface{}{
+				"family":  []string{"RedHat", "Debian"}[i%2],
+				"release": map[string]interface{}{"major": []string{"9", "12"}[i%2]},
+			}, Environment: environment},
+		)
+	}
+}
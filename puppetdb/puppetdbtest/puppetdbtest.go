@@ -0,0 +1,217 @@
+// Package puppetdbtest provides a fake PuppetDB serving canned nodes, reports
+// and facts, to test code consuming the PuppetDB client or the exporter
+// without a live PuppetDB
+package puppetdbtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iobear/prometheus-puppetdb-exporter/puppetdb"
+)
+
+// Server is a fake PuppetDB. Its fields may be changed between queries,
+// while holding Mu when the server is in use.
+type Server struct {
+	*httptest.Server
+
+	Mu sync.Mutex
+	// Version is the PuppetDB version returned by the metadata API
+	Version string
+	Status  puppetdb.ServiceStatus
+	Nodes   []puppetdb.Node
+	// Reports are returned by the reports endpoint, filtered by certname
+	// when the query names one of them
+	Reports []puppetdb.Report
+	// ReportMetrics and ReportLogs are the metrics and logs by report hash
+	ReportMetrics map[string][]puppetdb.ReportMetric
+	ReportLogs    map[string][]puppetdb.ReportLog
+	// Facts are returned by the facts endpoint, filtered by name
+	Facts []puppetdb.Fact
+	// Fail, when set, answers the requests it returns true for with a 500
+	// Internal Server Error, e.g. to test the handling of failed queries
+	Fail func(r *http.Request) bool
+
+	// refresh updates the data before the nodes are returned, set by
+	// NewMock
+	refresh func(now time.Time)
+}
+
+// NewServer starts a fake PuppetDB serving the given nodes. Close it once
+// done.
+func NewServer(nodes ...puppetdb.Node) *Server {
+	s := &Server{
+		Version:       "8.0.0",
+		Nodes:         nodes,
+		ReportMetrics: map[string][]puppetdb.ReportMetric{},
+		ReportLogs:    map[string][]puppetdb.ReportLog{},
+	}
+	s.Status.ServiceVersion = s.Version
+	s.Status.State = "running"
+	s.Status.Status.ReadDBUp = true
+	s.Status.Status.WriteDBUp = true
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// QueryURL returns the URL of the query API, the PuppetDB URL of the client
+// options
+func (s *Server) QueryURL() string {
+	return s.Server.URL + "/pdb/query"
+}
+
+// Options returns client options connecting to the fake PuppetDB
+func (s *Server) Options() *puppetdb.Options {
+	return &puppetdb.Options{URL: s.QueryURL()}
+}
+
+// serve answers the queries, with an empty list for the endpoints without
+// canned data
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	if s.Fail != nil && s.Fail(r) {
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query().Get("query")
+	path := strings.TrimPrefix(r.URL.Path, "/pdb/query/v4/")
+	switch {
+	case r.URL.Path == "/pdb/meta/v1/version":
+		reply(w, map[string]string{"version": s.Version})
+	case r.URL.Path == "/status/v1/services/puppetdb-status":
+		reply(w, s.Status)
+	case path == "nodes":
+		if s.refresh != nil {
+			s.refresh(time.Now())
+		}
+		w.Header().Set("X-Records", strconv.Itoa(len(s.Nodes)))
+		reply(w, page(orEmpty(s.Nodes), r))
+	case path == "reports":
+		reply(w, s.reports(query))
+	case strings.HasPrefix(path, "reports/") && strings.HasSuffix(path, "/metrics"):
+		reply(w, orEmpty(s.ReportMetrics[strings.Split(path, "/")[1]]))
+	case strings.HasPrefix(path, "reports/") && strings.HasSuffix(path, "/logs"):
+		reply(w, orEmpty(s.ReportLogs[strings.Split(path, "/")[1]]))
+	case path == "facts":
+		reply(w, s.facts(query))
+	case path == "fact-contents":
+		reply(w, s.factContents(query))
+	case strings.HasPrefix(r.URL.Path, "/pdb/query/v4"):
+		reply(w, []struct{}{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// reports returns the reports of the certname the query names, every one
+// when it names none
+func (s *Server) reports(query string) []puppetdb.Report {
+	var matching []puppetdb.Report
+	for _, r := range s.Reports {
+		if strings.Contains(query, strconv.Quote(r.Certname)) {
+			matching = append(matching, r)
+		}
+	}
+	if matching == nil {
+		return orEmpty(s.Reports)
+	}
+	return matching
+}
+
+// facts returns the facts whose names are listed by the query, e.g.
+// ["in", "name", ["array", ["os"]]]
+func (s *Server) facts(query string) []puppetdb.Fact {
+	var ast, array []json.RawMessage
+	var names []string
+	if json.Unmarshal([]byte(query), &ast) == nil && len(ast) == 3 &&
+		json.Unmarshal(ast[2], &array) == nil && len(array) == 2 {
+		json.Unmarshal(array[1], &names)
+	}
+
+	facts := []puppetdb.Fact{}
+	for _, f := range s.Facts {
+		if names == nil || slices.Contains(names, f.Name) {
+			facts = append(facts, f)
+		}
+	}
+	return facts
+}
+
+// factContents returns the values nested in the facts at the paths listed by
+// the query, e.g. ["or", ["=", "path", ["os", "family"]]]
+func (s *Server) factContents(query string) []puppetdb.FactContent {
+	var clauses []json.RawMessage
+	json.Unmarshal([]byte(query), &clauses)
+
+	contents := []puppetdb.FactContent{}
+	for _, clause := range clauses {
+		var ast []json.RawMessage
+		var path []string
+		if json.Unmarshal(clause, &ast) != nil || len(ast) != 3 || json.Unmarshal(ast[2], &path) != nil || len(path) == 0 {
+			continue
+		}
+		elements := make([]interface{}, len(path))
+		for i, element := range path {
+			elements[i] = element
+		}
+		for _, f := range s.Facts {
+			if f.Name != path[0] {
+				continue
+			}
+			value, ok := f.Value, true
+			for _, key := range path[1:] {
+				var m map[string]interface{}
+				if m, ok = value.(map[string]interface{}); !ok {
+					break
+				}
+				if value, ok = m[key]; !ok {
+					break
+				}
+			}
+			if ok {
+				contents = append(contents, puppetdb.FactContent{
+					Certname:    f.Certname,
+					Path:        elements,
+					Name:        f.Name,
+					Value:       value,
+					Environment: f.Environment,
+				})
+			}
+		}
+	}
+	return contents
+}
+
+// page returns the part of the list selected by the offset and limit
+// parameters of the request
+func page[T any](list []T, r *http.Request) []T {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	list = list[min(max(offset, 0), len(list)):]
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 {
+		list = list[:min(limit, len(list))]
+	}
+	return list
+}
+
+// orEmpty returns an empty list rather than nil, encoded as null
+func orEmpty[T any](list []T) []T {
+	if list == nil {
+		return []T{}
+	}
+	return list
+}
+
+func reply(w http.ResponseWriter, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(object)
+}
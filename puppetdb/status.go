@@ -0,0 +1,98 @@
+package puppetdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// ServiceStatus is the status of the PuppetDB service returned by the status API
+type ServiceStatus struct {
+	ServiceVersion string `json:"service_version"`
+	State          string `json:"state"`
+	Status         struct {
+		MaintenanceMode bool `json:"maintenance_mode?"`
+		QueueDepth      int  `json:"queue_depth"`
+		ReadDBUp        bool `json:"read_db_up?"`
+		WriteDBUp       bool `json:"write_db_up?"`
+	} `json:"status"`
+}
+
+// Running reports whether the service is running and able to answer queries
+func (s *ServiceStatus) Running() bool {
+	return s.State == "running" && !s.Status.MaintenanceMode
+}
+
+// ServerStatus is the status of one of the configured PuppetDB servers
+type ServerStatus struct {
+	URL string
+	// Primary is set for the server configured as the primary
+	Primary bool
+	// Active is set for the server queries are sent to
+	Active bool
+	// Status is nil when the status API could not be reached
+	Status *ServiceStatus
+	Err    error
+}
+
+// Failover checks the status of the configured servers and directs queries to
+// the first one, in priority order, which is running. The active server is
+// left unchanged when none of them is.
+func (p *PuppetDB) Failover(ctx context.Context) []ServerStatus {
+	p.mu.RLock()
+	servers := p.servers
+	p.mu.RUnlock()
+
+	statuses := make([]ServerStatus, len(servers))
+	var active *server
+
+	for i, srv := range servers {
+		statuses[i] = ServerStatus{
+			URL:     srv.url,
+			Primary: i == 0,
+		}
+
+		status, err := p.serviceStatus(ctx, srv)
+		if err != nil {
+			statuses[i].Err = err
+			continue
+		}
+		statuses[i].Status = status
+
+		if active == nil && status.Running() {
+			active = srv
+		}
+	}
+
+	p.mu.Lock()
+	if active != nil {
+		p.active = active
+	}
+	for i, srv := range servers {
+		statuses[i].Active = srv == p.active
+	}
+	p.mu.Unlock()
+
+	return statuses
+}
+
+// Status returns the status of the PuppetDB service queries are sent to
+func (p *PuppetDB) Status(ctx context.Context) (*ServiceStatus, error) {
+	return p.serviceStatus(ctx, p.current())
+}
+
+func (p *PuppetDB) serviceStatus(ctx context.Context, srv *server) (status *ServiceStatus, err error) {
+	if timeout := p.timeout(QueryStatus); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	status = &ServiceStatus{}
+	err = fetch(ctx, srv.client, srv.rootURL+"/status/v1/services/puppetdb-status", status)
+	p.succeeded(QueryStatus, err)
+	if err != nil {
+		err = fmt.Errorf("failed to get status of %s: %s", srv.url, err)
+		return nil, err
+	}
+	return
+}
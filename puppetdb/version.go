@@ -0,0 +1,102 @@
+package puppetdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Query features which older PuppetDB versions lack
+const (
+	featureProducer = "producer"
+	featureOrigin   = "origin"
+	featureTimeout  = "timeout"
+)
+
+// featureVersions are the first PuppetDB versions supporting the query
+// features, conservatively for the query parameters which are merely
+// omitted on older versions
+var featureVersions = map[string][3]int{
+	featureProducer: {5, 2, 0},
+	featureOrigin:   {7, 0, 0},
+	featureTimeout:  {7, 6, 0},
+}
+
+// DetectVersion retrieves the version of the PuppetDB queries are sent to
+// from its metadata API, and adapts the queries to it. The latest detected
+// version remains in use when it fails, the latest one supported as long as
+// none was detected.
+func (p *PuppetDB) DetectVersion(ctx context.Context) (string, error) {
+	if timeout := p.timeout(QueryStatus); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	srv := p.current()
+	var response struct {
+		Version string `json:"version"`
+	}
+	err := fetch(ctx, srv.client, metaURL(srv.baseURL)+"/v1/version", &response)
+	p.succeeded(QueryStatus, err)
+	if err != nil {
+		return "", fmt.Errorf("failed to get version of %s: %s", srv.url, err)
+	}
+
+	version, err := parseVersion(response.Version)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.version = &version
+	return response.Version, nil
+}
+
+// supports reports whether the PuppetDB supports the query feature
+func (p *PuppetDB) supports(feature string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.version == nil {
+		return true
+	}
+
+	first := featureVersions[feature]
+	for i := range first {
+		if p.version[i] != first[i] {
+			return p.version[i] > first[i]
+		}
+	}
+	return true
+}
+
+// unsupported returns the error of a query relying on a feature the
+// PuppetDB lacks
+func unsupported(feature string) error {
+	v := featureVersions[feature]
+	return fmt.Errorf("%s requires PuppetDB %d.%d.%d or later", feature, v[0], v[1], v[2])
+}
+
+// metaURL returns the URL of the metadata API, served next to the query API,
+// e.g. http://puppetdb:8080/pdb/meta for http://puppetdb:8080/pdb/query
+func metaURL(baseURL string) string {
+	base := strings.TrimRight(baseURL, "/")
+	if strings.HasSuffix(base, "/query") {
+		return strings.TrimSuffix(base, "/query") + "/meta"
+	}
+	return base + "/pdb/meta"
+}
+
+// parseVersion parses a version such as 8.2.0 or 7.18.1-SNAPSHOT into its
+// major, minor and patch numbers
+func parseVersion(version string) (v [3]int, err error) {
+	numbers := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	for i, n := range numbers {
+		if v[i], err = strconv.Atoi(n); err != nil {
+			return v, fmt.Errorf("invalid PuppetDB version %q", version)
+		}
+	}
+	return v, nil
+}